@@ -19,7 +19,28 @@ func (a *API) CreateRoutes(router *mux.Router) {
 	v1.HandleFunc("/records/{id}", a.PostRecordsV1).Methods("POST")
 
 	v2 := router.PathPrefix("/api/v2").Subrouter()
-	v2.HandleFunc("/records/{id}", a.GetRecordsV2).Methods("GET")
-	v2.HandleFunc("/records/{id}", a.PostRecordsV2).Methods("POST")
-	v2.HandleFunc("/records/{id}/versions", a.GetRecordVersionsV2).Methods("GET")
+	v2.HandleFunc("/search", a.SearchRecordsV2).Methods("GET")
+	v2.HandleFunc("/snapshot", a.SnapshotV2).Methods("GET")
+
+	v2.HandleFunc("/admin/collections", a.GetCollectionsV2).Methods("GET")
+	v2.HandleFunc("/admin/collections/{name}", a.PutCollectionV2).Methods("PUT")
+	v2.HandleFunc("/admin/collections/{name}/schema", a.GetSchemaV2).Methods("GET")
+	v2.HandleFunc("/admin/collections/{name}/schema", a.PutSchemaV2).Methods("PUT")
+	v2.HandleFunc("/admin/indexes", a.GetIndexesV2).Methods("GET")
+	v2.HandleFunc("/admin/indexes/rebuild", a.RebuildIndexesV2).Methods("POST")
+	v2.HandleFunc("/admin/indexes/{key}", a.PutIndexV2).Methods("PUT")
+	v2.HandleFunc("/admin/indexes/{key}", a.DeleteIndexV2).Methods("DELETE")
+
+	// Records live in collections, /api/v2/records being the default one.
+	// These routes come last so that the ones above take precedence.
+	v2.HandleFunc("/{collection}", a.ListRecordsV2).Methods("GET")
+	v2.HandleFunc("/{collection}/{id}", a.GetRecordsV2).Methods("GET")
+	v2.HandleFunc("/{collection}/{id}", a.PostRecordsV2).Methods("POST", "PATCH")
+	v2.HandleFunc("/{collection}/{id}", a.DeleteRecordsV2).Methods("DELETE")
+	v2.HandleFunc("/{collection}/{id}/restore", a.RestoreRecordsV2).Methods("POST")
+	v2.HandleFunc("/{collection}/{id}/revert", a.RevertRecordsV2).Methods("POST")
+	v2.HandleFunc("/{collection}/{id}/versions", a.GetRecordVersionsV2).Methods("GET")
+	v2.HandleFunc("/{collection}/{id}/diff", a.GetRecordDiffV2).Methods("GET")
+	v2.HandleFunc("/{collection}/{id}/fields/{key}/history", a.GetFieldHistoryV2).Methods("GET")
+	v2.HandleFunc("/{collection}/{id}/blame", a.GetRecordBlameV2).Methods("GET")
 }
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/rainbowmga/timetravel/service"
+)
+
+// reservedCollections cannot be used as collection names, as their routes
+// would be shadowed by other v2 endpoints.
+var reservedCollections = map[string]bool{"admin": true, "search": true, "snapshot": true}
+
+// collection returns the record service for the collection named in the
+// route, writing an error if the name is invalid. Routes without a collection
+// use the default one.
+func (a *API) collection(w http.ResponseWriter, r *http.Request) (service.RecordService, bool) {
+	vars := mux.Vars(r)
+	name, ok := vars["collection"]
+	if !ok {
+		name, ok = vars["name"]
+	}
+	if !ok {
+		name = r.URL.Query().Get("collection")
+	}
+	if name == "" {
+		return a.records, true
+	}
+
+	if reservedCollections[name] {
+		err := writeError(w, fmt.Sprintf("invalid collection; %q is reserved", name), http.StatusBadRequest)
+		logError(err)
+		return nil, false
+	}
+
+	records, err := a.records.Collection(name)
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return nil, false
+	}
+	return records, true
+}
+
+func (a *API) GetCollectionsV2(w http.ResponseWriter, r *http.Request) {
+	names, err := a.records.ListCollections(r.Context())
+	if err != nil {
+		err := writeError(w, ErrInternal.Error(), http.StatusInternalServerError)
+		logError(err)
+		return
+	}
+
+	err = writeJSON(w, map[string][]string{"collections": names}, http.StatusOK)
+	logError(err)
+}
+
+func (a *API) PutCollectionV2(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if reservedCollections[name] {
+		err := writeError(w, fmt.Sprintf("invalid collection; %q is reserved", name), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	if err := a.records.CreateCollection(r.Context(), name); err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	err := writeJSON(w, map[string]string{"name": name}, http.StatusOK)
+	logError(err)
+}
+
+func (a *API) GetSchemaV2(w http.ResponseWriter, r *http.Request) {
+	records, ok := a.collection(w, r)
+	if !ok {
+		return
+	}
+
+	var versionNumber int64
+	if version := r.URL.Query().Get("version"); version != "" {
+		var err error
+		versionNumber, err = strconv.ParseInt(version, 10, 32)
+		if err != nil || versionNumber <= 0 {
+			err := writeError(w, "invalid version; version must be a positive number", http.StatusBadRequest)
+			logError(err)
+			return
+		}
+	}
+
+	schema, err := records.GetSchema(r.Context(), int(versionNumber))
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	err = writeJSON(w, schema, http.StatusOK)
+	logError(err)
+}
+
+func (a *API) PutSchemaV2(w http.ResponseWriter, r *http.Request) {
+	records, ok := a.collection(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		err := writeError(w, "invalid input; could not read body", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	schema, err := records.SetSchema(r.Context(), body)
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	err = writeJSON(w, schema, http.StatusOK)
+	logError(err)
+}
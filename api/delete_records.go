@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+func (a *API) DeleteRecordsV2(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	records, ok := a.collection(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	idNumber, err := strconv.ParseInt(id, 10, 32)
+
+	if err != nil || idNumber <= 0 {
+		err := writeError(w, "invalid id; id must be a positive number", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	opts, err := parseWriteOptions(r)
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	record, err := records.DeleteRecord(ctx, int(idNumber), opts)
+	if err != nil {
+		err := writeWriteError(w, err)
+		logError(err)
+		return
+	}
+
+	setETag(w, record.Version)
+	err = writeJSON(w, visible(record), http.StatusOK)
+	logError(err)
+}
+
+func (a *API) RestoreRecordsV2(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	records, ok := a.collection(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	idNumber, err := strconv.ParseInt(id, 10, 32)
+
+	if err != nil || idNumber <= 0 {
+		err := writeError(w, "invalid id; id must be a positive number", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	opts, err := parseWriteOptions(r)
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	record, err := records.RestoreRecord(ctx, int(idNumber), opts)
+	if err != nil {
+		err := writeWriteError(w, err)
+		logError(err)
+		return
+	}
+
+	setETag(w, record.Version)
+	err = writeJSON(w, record, http.StatusOK)
+	logError(err)
+}
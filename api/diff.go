@@ -0,0 +1,189 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rainbowmga/timetravel/entity"
+	"github.com/rainbowmga/timetravel/service"
+)
+
+// recordDiff is the response of the diff endpoint.
+type recordDiff struct {
+	ID   int `json:"id"`
+	From int `json:"from"`
+	To   int `json:"to"`
+	// The remaining fields are only set when diffing two points in time.
+	FromTime *time.Time  `json:"from_time,omitempty"`
+	ToTime   *time.Time  `json:"to_time,omitempty"`
+	KnownAt  *time.Time  `json:"known_at,omitempty"`
+	Window   *timeWindow `json:"window,omitempty"`
+	// Windows holds, for each key added, removed or changed, the period
+	// during which its new value was in force.
+	Windows map[string]timeWindow `json:"windows,omitempty"`
+	entity.DataDiff
+}
+
+// timeWindow is the period during which the changes of a diff were in force.
+type timeWindow struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+func (a *API) GetRecordDiffV2(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	records, ok := a.collection(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+
+	idNumber, err := strconv.ParseInt(id, 10, 32)
+	if err != nil || idNumber <= 0 {
+		err := writeError(w, "invalid id; id must be a positive number", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("from_time") != "" || query.Get("to_time") != "" {
+		if query.Get("from") != "" || query.Get("to") != "" {
+			err := writeError(w, "from/to cannot be combined with from_time/to_time", http.StatusBadRequest)
+			logError(err)
+			return
+		}
+		getRecordTimeDiff(w, r, records, int(idNumber))
+		return
+	}
+
+	from, err := strconv.ParseInt(query.Get("from"), 10, 32)
+	if err != nil || from <= 0 {
+		err := writeError(w, "invalid from; from must be a positive version number", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+	to, err := strconv.ParseInt(query.Get("to"), 10, 32)
+	if err != nil || to <= 0 {
+		err := writeError(w, "invalid to; to must be a positive version number", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	before, err := records.GetRecordVersion(ctx, int(idNumber), int(from))
+	if err != nil {
+		err := writeError(w, fmt.Sprintf("failed to get version %d: %v", from, err), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+	after, err := records.GetRecordVersion(ctx, int(idNumber), int(to))
+	if err != nil {
+		err := writeError(w, fmt.Sprintf("failed to get version %d: %v", to, err), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	err = writeJSON(w, recordDiff{
+		ID:       int(idNumber),
+		From:     before.Version,
+		To:       after.Version,
+		DataDiff: entity.DiffData(before.VisibleData(), after.VisibleData()),
+	}, http.StatusOK)
+	logError(err)
+}
+
+// getRecordTimeDiff diffs the versions in force at from_time and to_time, as
+// known at known_at (default now).
+func getRecordTimeDiff(w http.ResponseWriter, r *http.Request, records service.RecordService, id int) {
+	ctx := r.Context()
+
+	fromTime, hasFrom, err := parseTimeParam(r, "from_time")
+	if err == nil && !hasFrom {
+		err = errors.New("from_time is required")
+	}
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+	toTime, hasTo, err := parseTimeParam(r, "to_time")
+	if err == nil && !hasTo {
+		err = errors.New("to_time is required")
+	}
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+	if toTime.Before(fromTime) {
+		err := writeError(w, "to_time must not be before from_time", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+	knownAt, hasKnownAt, err := parseTimeParam(r, "known_at")
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+	if !hasKnownAt {
+		knownAt = time.Now().UTC()
+	}
+
+	before, err := records.GetRecordBitemporal(ctx, id, fromTime, knownAt)
+	if err != nil {
+		err := writeError(w, fmt.Sprintf("failed to get record at from_time: %v", err), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+	after, err := records.GetRecordBitemporal(ctx, id, toTime, knownAt)
+	if err != nil {
+		err := writeError(w, fmt.Sprintf("failed to get record at to_time: %v", err), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	diff := recordDiff{
+		ID:       id,
+		From:     before.Version,
+		To:       after.Version,
+		FromTime: &fromTime,
+		ToTime:   &toTime,
+		KnownAt:  &knownAt,
+		DataDiff: entity.DiffData(before.Data, after.Data),
+	}
+
+	// Each change has been in force since its key took its new value, which
+	// may be before the later version took effect when several versions
+	// fall in between. The window covers them all.
+	if !diff.Empty() {
+		history, err := records.GetRecordHistory(ctx, id)
+		if err != nil {
+			err := writeError(w, fmt.Sprintf("failed to get record history: %v", err), http.StatusBadRequest)
+			logError(err)
+			return
+		}
+		known := 0
+		for known < len(history) && !history[known].RecordedAt.After(knownAt) {
+			known++
+		}
+
+		keys := append(append(diff.AddedKeys(), diff.RemovedKeys()...), diff.ChangedKeys()...)
+		window := timeWindow{From: toTime, To: toTime}
+		diff.Windows = make(map[string]timeWindow, len(keys))
+		for key, since := range entity.EffectiveSince(history[:known], keys, fromTime, toTime) {
+			diff.Windows[key] = timeWindow{From: since, To: toTime}
+			if since.Before(window.From) {
+				window.From = since
+			}
+		}
+		diff.Window = &window
+	}
+
+	err = writeJSON(w, diff, http.StatusOK)
+	logError(err)
+}
@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/rainbowmga/timetravel/entity"
+	"github.com/rainbowmga/timetravel/service"
 )
 
 func (a *API) GetRecordsV1(w http.ResponseWriter, r *http.Request) {
@@ -26,14 +30,37 @@ func (a *API) GetRecordsV1(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = writeJSON(w, record, http.StatusOK)
+	err = writeJSON(w, newRecordV1(record), http.StatusOK)
 	logError(err)
 }
 
 func (a *API) GetRecordsV2(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	records, ok := a.collection(w, r)
+	if !ok {
+		return
+	}
+
 	id := mux.Vars(r)["id"]
 	version := r.URL.Query().Get("version")
+	asOf, hasAsOf, err := parseTimeParam(r, "as_of")
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+	effectiveAt, hasEffectiveAt, err := parseTimeParam(r, "effective_at")
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+	knownAt, hasKnownAt, err := parseTimeParam(r, "known_at")
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
 
 	idNumber, err := strconv.ParseInt(id, 10, 32)
 	if err != nil || idNumber <= 0 {
@@ -42,19 +69,49 @@ func (a *API) GetRecordsV2(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var record interface{}
+	var record entity.Record
 	var getErr error
+	var expand service.ExpandOptions
+
+	selectors := 0
+	for _, set := range []bool{version != "", hasAsOf, hasEffectiveAt || hasKnownAt} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors > 1 {
+		err := writeError(w, "only one of version, as_of or effective_at/known_at may be given", http.StatusBadRequest)
+		logError(err)
+		return
+	}
 
-	if version == "" {
-		record, getErr = a.records.GetRecord(ctx, int(idNumber))
-	} else {
+	switch {
+	case hasAsOf:
+		record, getErr = records.GetRecordAsOf(ctx, int(idNumber), asOf)
+		expand.AsOf = asOf
+	case hasEffectiveAt || hasKnownAt:
+		now := time.Now()
+		if !hasEffectiveAt {
+			effectiveAt = now
+		}
+		if !hasKnownAt {
+			knownAt = now
+		}
+		record, getErr = records.GetRecordBitemporal(ctx, int(idNumber), effectiveAt, knownAt)
+		expand.EffectiveAt = effectiveAt
+		expand.KnownAt = knownAt
+	case version != "":
 		versionNumber, err := strconv.ParseInt(version, 10, 32)
 		if err != nil || versionNumber <= 0 {
 			err := writeError(w, "invalid version; version must be a positive number", http.StatusBadRequest)
 			logError(err)
 			return
 		}
-		record, getErr = a.records.GetRecordVersion(ctx, int(idNumber), int(versionNumber))
+		record, getErr = records.GetRecordVersion(ctx, int(idNumber), int(versionNumber))
+		// References resolve to what was known when the version was written.
+		expand.AsOf = record.RecordedAt
+	default:
+		record, getErr = records.GetRecord(ctx, int(idNumber))
 	}
 
 	if getErr != nil {
@@ -62,13 +119,56 @@ func (a *API) GetRecordsV2(w http.ResponseWriter, r *http.Request) {
 		logError(err)
 		return
 	}
+	// Only reads by version can return a tombstone.
+	record = visible(record)
 
-	err = writeJSON(w, record, http.StatusOK)
+	expand.Keys = parseExpand(r)
+	if len(expand.Keys) == 0 {
+		setETag(w, record.Version)
+		err = writeJSON(w, record, http.StatusOK)
+		logError(err)
+		return
+	}
+
+	expanded, err := service.ExpandReferences(ctx, a.records, record.Data, expand)
+	if err != nil {
+		err := writeError(w, fmt.Sprintf("failed to expand references: %v", err), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	setETag(w, record.Version)
+	err = writeJSON(w, expandedRecord{record, expanded}, http.StatusOK)
 	logError(err)
 }
 
+// expandedRecord is a record with the records its references resolved to.
+type expandedRecord struct {
+	entity.Record
+	Expanded map[string]interface{} `json:"expanded"`
+}
+
+// parseExpand returns the keys listed by the expand parameters, which may be
+// repeated or comma separated.
+func parseExpand(r *http.Request) []string {
+	var keys []string
+	for _, expand := range r.URL.Query()["expand"] {
+		for _, key := range strings.Split(expand, ",") {
+			if key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
 func (a *API) GetRecordVersionsV2(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	records, ok := a.collection(w, r)
+	if !ok {
+		return
+	}
+
 	id := mux.Vars(r)["id"]
 
 	idNumber, err := strconv.ParseInt(id, 10, 32)
@@ -78,13 +178,31 @@ func (a *API) GetRecordVersionsV2(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	versions, err := a.records.GetRecordVersions(ctx, int(idNumber))
+	versions, err := records.GetRecordVersions(ctx, int(idNumber))
 	if err != nil {
 		err := writeError(w, fmt.Sprintf("failed to get record versions: %v", err), http.StatusBadRequest)
 		logError(err)
 		return
 	}
 
-	err = writeJSON(w, versions, http.StatusOK)
+	// The bare list of version numbers stays the default for existing clients.
+	switch r.URL.Query().Get("format") {
+	case "", "numbers":
+	case "full":
+		err = writeJSON(w, versions, http.StatusOK)
+		logError(err)
+		return
+	default:
+		err := writeError(w, "invalid format; must be numbers or full", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	numbers := make([]int, len(versions))
+	for i, version := range versions {
+		numbers[i] = version.Version
+	}
+
+	err = writeJSON(w, numbers, http.StatusOK)
 	logError(err)
 }
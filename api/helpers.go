@@ -3,8 +3,14 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rainbowmga/timetravel/entity"
+	"github.com/rainbowmga/timetravel/service"
 )
 
 var (
@@ -35,3 +41,77 @@ func writeError(w http.ResponseWriter, message string, statusCode int) error {
 		statusCode,
 	)
 }
+
+// writeWriteError reports a failed write, using 409 Conflict for optimistic
+// concurrency failures and failed JSON Patch tests, and 412 Precondition
+// Failed for If-Match: * on a missing record.
+func writeWriteError(w http.ResponseWriter, err error) error {
+	var conflict *service.VersionConflictError
+	if errors.As(err, &conflict) {
+		return writeConflict(w, conflict)
+	}
+	var invalid *service.SchemaValidationError
+	if errors.As(err, &invalid) {
+		return writeValidationError(w, invalid)
+	}
+	if errors.Is(err, service.ErrPatchTestFailed) {
+		return writeError(w, err.Error(), http.StatusConflict)
+	}
+	if errors.Is(err, service.ErrPreconditionFailed) {
+		return writeError(w, err.Error(), http.StatusPreconditionFailed)
+	}
+	return writeError(w, err.Error(), http.StatusBadRequest)
+}
+
+// writeConflict reports a failed optimistic concurrency check along with the
+// record's current version.
+func writeConflict(w http.ResponseWriter, conflict *service.VersionConflictError) error {
+	log.Printf("response errored: %v", conflict)
+	return writeJSON(
+		w,
+		map[string]interface{}{"error": conflict.Error(), "current_version": conflict.Current},
+		http.StatusConflict,
+	)
+}
+
+// writeValidationError reports the fields of a write that do not match the
+// collection's schema.
+func writeValidationError(w http.ResponseWriter, invalid *service.SchemaValidationError) error {
+	log.Printf("response errored: %v", invalid)
+	return writeJSON(
+		w,
+		map[string]interface{}{
+			"error":          service.ErrSchemaValidation.Error(),
+			"schema_version": invalid.SchemaVersion,
+			"errors":         invalid.Errors,
+		},
+		http.StatusBadRequest,
+	)
+}
+
+// setETag exposes the record version so clients can send it back in If-Match.
+func setETag(w http.ResponseWriter, version int) {
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(version)))
+}
+
+// visible hides the data a tombstone keeps for restores, so that deleted
+// versions are returned without data.
+func visible(record entity.Record) entity.Record {
+	record.Data = record.VisibleData()
+	return record
+}
+
+// parseTimeParam parses an optional RFC3339 query parameter. The bool reports
+// whether the parameter was present.
+func parseTimeParam(r *http.Request, name string) (time.Time, bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid %s; must be an RFC3339 timestamp", name)
+	}
+	return t, true, nil
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/rainbowmga/timetravel/entity"
+	"github.com/rainbowmga/timetravel/service"
+)
+
+func (a *API) GetFieldHistoryV2(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	records, ok := a.collection(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	key := mux.Vars(r)["key"]
+
+	idNumber, err := strconv.ParseInt(id, 10, 32)
+	if err != nil || idNumber <= 0 {
+		err := writeError(w, "invalid id; id must be a positive number", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	history, err := records.GetRecordHistory(ctx, int(idNumber))
+	if err != nil {
+		err := writeError(w, fmt.Sprintf("failed to get record history: %v", err), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	spans := entity.FieldHistory(history, key)
+	if len(spans) == 0 {
+		err := writeError(w, fmt.Sprintf("key %q was never set on record %d", key, idNumber), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	err = writeJSON(w, spans, http.StatusOK)
+	logError(err)
+}
+
+// recordBlame is the response of the blame endpoint.
+type recordBlame struct {
+	ID      int                          `json:"id"`
+	Version int                          `json:"version"`
+	Fields  map[string]entity.BlameEntry `json:"fields"`
+}
+
+func (a *API) GetRecordBlameV2(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	records, ok := a.collection(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	version := r.URL.Query().Get("version")
+
+	idNumber, err := strconv.ParseInt(id, 10, 32)
+	if err != nil || idNumber <= 0 {
+		err := writeError(w, "invalid id; id must be a positive number", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	history, err := records.GetRecordHistory(ctx, int(idNumber))
+	if err != nil {
+		err := writeError(w, fmt.Sprintf("failed to get record history: %v", err), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	// Default to the latest version.
+	i := len(history) - 1
+	if version != "" {
+		versionNumber, err := strconv.ParseInt(version, 10, 32)
+		if err != nil || versionNumber <= 0 {
+			err := writeError(w, "invalid version; version must be a positive number", http.StatusBadRequest)
+			logError(err)
+			return
+		}
+		for i >= 0 && history[i].Version != int(versionNumber) {
+			i--
+		}
+		if i < 0 {
+			err := writeError(w, fmt.Sprintf("failed to get record: %v", service.ErrVersionNotFound), http.StatusBadRequest)
+			logError(err)
+			return
+		}
+	}
+
+	if history[i].Deleted {
+		err := writeError(w, fmt.Sprintf("record is deleted at version %d", history[i].Version), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	err = writeJSON(w, recordBlame{
+		ID:      int(idNumber),
+		Version: history[i].Version,
+		Fields:  entity.Blame(history, i),
+	}, http.StatusOK)
+	logError(err)
+}
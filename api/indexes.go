@@ -0,0 +1,86 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rainbowmga/timetravel/service"
+)
+
+// indexer returns the record service's index administration, writing an
+// error if the service does not maintain indexes.
+func (a *API) indexer(w http.ResponseWriter) (service.Indexer, bool) {
+	indexer, ok := a.records.(service.Indexer)
+	if !ok {
+		err := writeError(w, "indexes are not supported by this record service", http.StatusNotImplemented)
+		logError(err)
+	}
+	return indexer, ok
+}
+
+func (a *API) GetIndexesV2(w http.ResponseWriter, r *http.Request) {
+	indexer, ok := a.indexer(w)
+	if !ok {
+		return
+	}
+
+	keys, err := indexer.IndexedKeys(r.Context())
+	if err != nil {
+		err := writeError(w, ErrInternal.Error(), http.StatusInternalServerError)
+		logError(err)
+		return
+	}
+
+	err = writeJSON(w, map[string][]string{"keys": keys}, http.StatusOK)
+	logError(err)
+}
+
+func (a *API) PutIndexV2(w http.ResponseWriter, r *http.Request) {
+	indexer, ok := a.indexer(w)
+	if !ok {
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	if err := indexer.IndexKey(r.Context(), key); err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	err := writeJSON(w, map[string]string{"key": key}, http.StatusOK)
+	logError(err)
+}
+
+func (a *API) DeleteIndexV2(w http.ResponseWriter, r *http.Request) {
+	indexer, ok := a.indexer(w)
+	if !ok {
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	if err := indexer.DropIndex(r.Context(), key); err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	err := writeJSON(w, map[string]string{"key": key}, http.StatusOK)
+	logError(err)
+}
+
+func (a *API) RebuildIndexesV2(w http.ResponseWriter, r *http.Request) {
+	indexer, ok := a.indexer(w)
+	if !ok {
+		return
+	}
+
+	if err := indexer.RebuildIndexes(r.Context()); err != nil {
+		err := writeError(w, ErrInternal.Error(), http.StatusInternalServerError)
+		logError(err)
+		return
+	}
+
+	err := writeJSON(w, map[string]bool{"ok": true}, http.StatusOK)
+	logError(err)
+}
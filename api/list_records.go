@@ -0,0 +1,88 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rainbowmga/timetravel/service"
+)
+
+func (a *API) ListRecordsV2(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	records, ok := a.collection(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+
+	opts := service.ListOptions{
+		SortBy: query.Get("sort"),
+		Cursor: query.Get("cursor"),
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		err := writeError(w, "invalid order; must be asc or desc", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		limitNumber, err := strconv.ParseInt(limit, 10, 32)
+		if err != nil || limitNumber <= 0 {
+			err := writeError(w, "invalid limit; limit must be a positive number", http.StatusBadRequest)
+			logError(err)
+			return
+		}
+		opts.Limit = int(limitNumber)
+	}
+
+	updatedSince, _, err := parseTimeParam(r, "updated_since")
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+	opts.UpdatedSince = updatedSince
+
+	asOf, _, err := parseTimeParam(r, "as_of")
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+	opts.AsOf = asOf
+
+	effectiveAt, _, err := parseTimeParam(r, "effective_at")
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+	opts.EffectiveAt = effectiveAt
+
+	for _, where := range query["where"] {
+		filter, err := service.ParseFilter(where)
+		if err != nil {
+			err := writeError(w, err.Error(), http.StatusBadRequest)
+			logError(err)
+			return
+		}
+		opts.Filters = append(opts.Filters, filter)
+	}
+
+	page, err := records.ListRecords(ctx, opts)
+	if err != nil {
+		err := writeError(w, fmt.Sprintf("failed to list records: %v", err), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	err = writeJSON(w, page, http.StatusOK)
+	logError(err)
+}
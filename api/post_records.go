@@ -3,8 +3,11 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"io"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/rainbowmga/timetravel/entity"
@@ -31,33 +34,34 @@ func (a *API) PostRecordsV1(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	record, err := a.records.GetRecord(ctx, int(idNumber))
-
-	if !errors.Is(err, service.ErrRecordDoesNotExist) { // record exists
-		record, err = a.records.UpdateRecord(ctx, int(idNumber), body)
-	} else { // record does not exist
-		recordMap := map[string]string{}
-		for key, value := range body {
-			if value != nil {
-				recordMap[key] = *value
-			}
+	// v1 only accepts strings; null still deletes the key.
+	updates := make(map[string]interface{}, len(body))
+	for key, value := range body {
+		if value == nil {
+			updates[key] = nil
+		} else {
+			updates[key] = *value
 		}
-		record = entity.Record{ID: int(idNumber), Data: recordMap}
-		err = a.records.CreateRecord(ctx, record)
 	}
 
+	record, err := a.records.UpsertRecord(ctx, int(idNumber), updates, service.WriteOptions{})
 	if err != nil {
 		err := writeError(w, err.Error(), http.StatusBadRequest)
 		logError(err)
 		return
 	}
 
-	err = writeJSON(w, record, http.StatusOK)
+	err = writeJSON(w, newRecordV1(record), http.StatusOK)
 	logError(err)
 }
 
 func (a *API) PostRecordsV2(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	records, ok := a.collection(w, r)
+	if !ok {
+		return
+	}
+
 	id := mux.Vars(r)["id"]
 	idNumber, err := strconv.ParseInt(id, 10, 32)
 
@@ -67,36 +71,156 @@ func (a *API) PostRecordsV2(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var body map[string]*string
-	err = json.NewDecoder(r.Body).Decode(&body)
+	opts, err := parseWriteOptions(r)
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
 
+	// v2 accepts any JSON value; null deletes the key. Patches are applied to
+	// the latest version instead of being merged into it.
+	var updates map[string]interface{}
+	var patch service.Patch
+	switch mediaType(r) {
+	case "application/json-patch+json":
+		body, err := io.ReadAll(r.Body)
+		if err == nil {
+			patch, err = service.ParseJSONPatch(body)
+		}
+		if err != nil {
+			err := writeError(w, err.Error(), http.StatusBadRequest)
+			logError(err)
+			return
+		}
+	case "application/merge-patch+json":
+		updates, err = readData(r)
+		patch = service.MergePatch(updates)
+	default:
+		updates, err = readData(r)
+	}
 	if err != nil {
 		err := writeError(w, "invalid input; could not parse json", http.StatusBadRequest)
 		logError(err)
 		return
 	}
 
-	record, err := a.records.GetRecord(ctx, int(idNumber))
-
-	if !errors.Is(err, service.ErrRecordDoesNotExist) { // record exists
-		record, err = a.records.UpdateRecordWithVersion(ctx, int(idNumber), body)
-	} else { // record does not exist
-		recordMap := map[string]string{}
-		for key, value := range body {
-			if value != nil {
-				recordMap[key] = *value
-			}
-		}
-		record = entity.Record{ID: int(idNumber), Data: recordMap, Version: 1}
-		err = a.records.CreateRecord(ctx, record)
+	if err := takeExpectedVersion(updates, &opts); err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
 	}
 
+	var record entity.Record
+	if patch != nil {
+		record, err = records.PatchRecord(ctx, int(idNumber), patch, opts)
+	} else {
+		record, err = records.UpsertRecord(ctx, int(idNumber), updates, opts)
+	}
 	if err != nil {
-		err := writeError(w, err.Error(), http.StatusBadRequest)
+		err := writeWriteError(w, err)
 		logError(err)
 		return
 	}
 
-	err = writeJSON(w, record, http.StatusOK)
+	// The latest version is a tombstone when the write was back-dated
+	// before a delete.
+	setETag(w, record.Version)
+	err = writeJSON(w, visible(record), http.StatusOK)
 	logError(err)
 }
+
+// mediaType returns the media type of the request body, without parameters.
+func mediaType(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// readData decodes a JSON object from the request body, keeping numbers as
+// written.
+func readData(r *http.Request) (map[string]interface{}, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return entity.UnmarshalData(body)
+}
+
+// parseWriteOptions reads the per-version metadata of a v2 write from the
+// request's query parameters and headers.
+func parseWriteOptions(r *http.Request) (service.WriteOptions, error) {
+	var opts service.WriteOptions
+
+	effectiveFrom, _, err := parseTimeParam(r, "effective_from")
+	if err != nil {
+		return opts, err
+	}
+	opts.EffectiveFrom = effectiveFrom
+
+	effectiveTo, ok, err := parseTimeParam(r, "effective_to")
+	if err != nil {
+		return opts, err
+	}
+	if ok {
+		opts.EffectiveTo = &effectiveTo
+	}
+
+	// An authentication layer in front of the service sets X-Actor to the
+	// caller's identity.
+	opts.Author = r.Header.Get("X-Actor")
+	opts.Reason = r.Header.Get("X-Change-Reason")
+
+	// The expected version comes from If-Match, or from expected_version for
+	// clients that cannot set headers: in the query of writes without a
+	// body, see takeExpectedVersion for the others. If-Match: * only asks
+	// for the record to exist.
+	expected := strings.Trim(strings.TrimPrefix(r.Header.Get("If-Match"), "W/"), `"`)
+	if expected == "*" {
+		opts.MustExist = true
+		expected = ""
+	}
+	if expected == "" {
+		expected = r.URL.Query().Get("expected_version")
+	}
+	if expected != "" {
+		version, err := parseExpectedVersion(expected)
+		if err != nil {
+			return opts, err
+		}
+		opts.ExpectedVersion = version
+	}
+
+	return opts, nil
+}
+
+func parseExpectedVersion(expected string) (int, error) {
+	version, err := strconv.ParseInt(expected, 10, 32)
+	if err != nil || version <= 0 {
+		return 0, errors.New("invalid expected version; must be a positive number")
+	}
+	return int(version), nil
+}
+
+// takeExpectedVersion removes expected_version from the JSON body of a write
+// and sets it as the expected version. The key is therefore not stored as
+// record data. It must agree with If-Match if both are given.
+func takeExpectedVersion(body map[string]interface{}, opts *service.WriteOptions) error {
+	value, ok := body["expected_version"]
+	if !ok {
+		return nil
+	}
+	delete(body, "expected_version")
+
+	version, err := parseExpectedVersion(entity.ValueString(value))
+	if err != nil {
+		return err
+	}
+	if opts.ExpectedVersion != 0 && opts.ExpectedVersion != version {
+		return errors.New("invalid expected version; If-Match and expected_version disagree")
+	}
+	opts.ExpectedVersion = version
+	return nil
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"time"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+// recordV1 is the record shape served by /api/v1. It is frozen so that v1
+// clients are unaffected by fields added to entity.Record for v2.
+type recordV1 struct {
+	ID        int               `json:"id"`
+	Data      map[string]string `json:"data"`
+	Version   int               `json:"version"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// dataV1 renders typed values, written through v2, as strings.
+func dataV1(data map[string]interface{}) map[string]string {
+	strings := make(map[string]string, len(data))
+	for key, value := range data {
+		strings[key] = entity.ValueString(value)
+	}
+	return strings
+}
+
+// newRecordV1 renders times in the server's local zone, as v1 did before
+// times were stored in UTC.
+func newRecordV1(record entity.Record) recordV1 {
+	return recordV1{
+		ID:        record.ID,
+		Data:      dataV1(record.Data),
+		Version:   record.Version,
+		CreatedAt: record.CreatedAt.In(time.Local),
+		UpdatedAt: record.UpdatedAt.In(time.Local),
+	}
+}
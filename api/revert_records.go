@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+func (a *API) RevertRecordsV2(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	records, ok := a.collection(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	idNumber, err := strconv.ParseInt(id, 10, 32)
+
+	if err != nil || idNumber <= 0 {
+		err := writeError(w, "invalid id; id must be a positive number", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	to, err := strconv.ParseInt(r.URL.Query().Get("to"), 10, 32)
+	if err != nil || to <= 0 {
+		err := writeError(w, "invalid to; to must be a positive version number", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	opts, err := parseWriteOptions(r)
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	record, err := records.RevertRecord(ctx, int(idNumber), int(to), opts)
+	if err != nil {
+		err := writeWriteError(w, err)
+		logError(err)
+		return
+	}
+
+	setETag(w, record.Version)
+	err = writeJSON(w, record, http.StatusOK)
+	logError(err)
+}
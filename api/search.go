@@ -0,0 +1,51 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rainbowmga/timetravel/service"
+)
+
+func (a *API) SearchRecordsV2(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	records, ok := a.collection(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+
+	opts := service.SearchOptions{Query: query.Get("q")}
+
+	switch query.Get("versions") {
+	case "", "latest":
+	case "all":
+		opts.AllVersions = true
+	default:
+		err := writeError(w, "invalid versions; must be latest or all", http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		limitNumber, err := strconv.ParseInt(limit, 10, 32)
+		if err != nil || limitNumber <= 0 {
+			err := writeError(w, "invalid limit; limit must be a positive number", http.StatusBadRequest)
+			logError(err)
+			return
+		}
+		opts.Limit = int(limitNumber)
+	}
+
+	results, err := records.SearchRecords(ctx, opts)
+	if err != nil {
+		err := writeError(w, fmt.Sprintf("failed to search records: %v", err), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+
+	err = writeJSON(w, map[string]interface{}{"records": results}, http.StatusOK)
+	logError(err)
+}
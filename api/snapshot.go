@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+// snapshotFlushRecords is the number of records written between flushes of a
+// snapshot, so that clients receive it as it is read.
+const snapshotFlushRecords = 100
+
+type connContextKey struct{}
+
+// ConnContext stores the connection of a request in its context, so that a
+// snapshot can lift the server's write timeout. It is meant to be used as
+// the http.Server's ConnContext.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// clearWriteDeadline lets the response to r take as long as it needs. The
+// server sets the deadline again before reading the next request.
+func clearWriteDeadline(r *http.Request) {
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		logError(conn.SetWriteDeadline(time.Time{}))
+	}
+}
+
+// SnapshotV2 streams the version of every record that was current at as_of,
+// or now, as newline delimited JSON.
+func (a *API) SnapshotV2(w http.ResponseWriter, r *http.Request) {
+	asOf, hasAsOf, err := parseTimeParam(r, "as_of")
+	if err != nil {
+		err := writeError(w, err.Error(), http.StatusBadRequest)
+		logError(err)
+		return
+	}
+	if !hasAsOf {
+		asOf = time.Now()
+	}
+
+	// An export can outlast the server's write timeout.
+	clearWriteDeadline(r)
+	flusher, _ := w.(http.Flusher)
+
+	encoder := json.NewEncoder(w)
+	started := false
+	count := 0
+	err = a.records.Snapshot(r.Context(), asOf, func(record entity.Record) error {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+		count++
+		if flusher != nil && count%snapshotFlushRecords == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+
+	switch {
+	case err != nil && started:
+		// The status has been sent; the client sees a truncated stream.
+		logError(fmt.Errorf("snapshot as of %v interrupted: %w", asOf, err))
+	case err != nil:
+		logError(err)
+		err := writeError(w, ErrInternal.Error(), http.StatusInternalServerError)
+		logError(err)
+	case !started:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,75 @@
+package entity
+
+import "sort"
+
+// DataDiff describes how a record's data changed between two versions.
+type DataDiff struct {
+	Added   map[string]interface{} `json:"added"`
+	Removed map[string]interface{} `json:"removed"`
+	Changed map[string]ValueChange `json:"changed"`
+}
+
+// ValueChange holds the old and new value of a changed key.
+type ValueChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// DiffData compares two versions of a record's data.
+func DiffData(before, after map[string]interface{}) DataDiff {
+	diff := DataDiff{
+		Added:   map[string]interface{}{},
+		Removed: map[string]interface{}{},
+		Changed: map[string]ValueChange{},
+	}
+
+	for key, value := range after {
+		old, ok := before[key]
+		if !ok {
+			diff.Added[key] = value
+		} else if !EqualValues(old, value) {
+			diff.Changed[key] = ValueChange{Before: old, After: value}
+		}
+	}
+	for key, value := range before {
+		if _, ok := after[key]; !ok {
+			diff.Removed[key] = value
+		}
+	}
+
+	return diff
+}
+
+// Empty reports whether the two versions hold the same data.
+func (d DataDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// AddedKeys returns the added keys in sorted order.
+func (d DataDiff) AddedKeys() []string {
+	return sortedKeys(d.Added)
+}
+
+// ChangedKeys returns the changed keys in sorted order.
+func (d DataDiff) ChangedKeys() []string {
+	keys := make([]string, 0, len(d.Changed))
+	for key := range d.Changed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RemovedKeys returns the removed keys in sorted order.
+func (d DataDiff) RemovedKeys() []string {
+	return sortedKeys(d.Removed)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,152 @@
+package entity
+
+import (
+	"sort"
+	"time"
+)
+
+// FieldSpan is a run of consecutive versions during which a key held the same
+// value. A nil Value means the key had been removed.
+type FieldSpan struct {
+	Value       interface{} `json:"value"`
+	FromVersion int         `json:"from_version"`
+	// ToVersion is the last version holding the value, nil while it is current.
+	ToVersion *int `json:"to_version,omitempty"`
+	// RecordedFrom and RecordedTo bound, in transaction time, when the value
+	// was held. RecordedTo is nil while it is current.
+	RecordedFrom  time.Time  `json:"recorded_from"`
+	RecordedTo    *time.Time `json:"recorded_to,omitempty"`
+	EffectiveFrom time.Time  `json:"effective_from"`
+	Author        string     `json:"author,omitempty"`
+}
+
+// FieldHistory collapses a record's history, ordered by version, into the
+// spans of values held by key. Versions before the key was first set are
+// skipped and tombstones count as the key being removed.
+func FieldHistory(history []Record, key string) []FieldSpan {
+	var spans []FieldSpan
+
+	for _, record := range history {
+		var value interface{}
+		if v, ok := record.Data[key]; ok && !record.Deleted {
+			value = v
+		}
+
+		if len(spans) == 0 {
+			if value == nil {
+				continue
+			}
+		} else if last := &spans[len(spans)-1]; EqualValues(last.Value, value) {
+			continue
+		} else {
+			toVersion := record.Version - 1
+			recordedTo := record.RecordedAt
+			last.ToVersion = &toVersion
+			last.RecordedTo = &recordedTo
+		}
+
+		spans = append(spans, FieldSpan{
+			Value:         value,
+			FromVersion:   record.Version,
+			RecordedFrom:  record.RecordedAt,
+			EffectiveFrom: record.EffectiveFrom,
+			Author:        record.Author,
+		})
+	}
+
+	return spans
+}
+
+// BlameEntry identifies the version that introduced a key's current value.
+type BlameEntry struct {
+	Value         interface{} `json:"value"`
+	Version       int         `json:"version"`
+	RecordedAt    time.Time   `json:"recorded_at"`
+	EffectiveFrom time.Time   `json:"effective_from"`
+	Author        string      `json:"author,omitempty"`
+	Reason        string      `json:"reason,omitempty"`
+}
+
+// Blame returns, for every key of the record at history[i], the version from
+// which the key has held its value without interruption up to history[i].
+// history must be ordered by version; tombstones interrupt every key.
+func Blame(history []Record, i int) map[string]BlameEntry {
+	blame := make(map[string]BlameEntry, len(history[i].Data))
+
+	for key, value := range history[i].Data {
+		origin := i
+		for origin > 0 {
+			previous := history[origin-1]
+			if v, ok := previous.Data[key]; !ok || !EqualValues(v, value) || previous.Deleted {
+				break
+			}
+			origin--
+		}
+
+		introduced := history[origin]
+		blame[key] = BlameEntry{
+			Value:         value,
+			Version:       introduced.Version,
+			RecordedAt:    introduced.RecordedAt,
+			EffectiveFrom: introduced.EffectiveFrom,
+			Author:        introduced.Author,
+			Reason:        introduced.Reason,
+		}
+	}
+
+	return blame
+}
+
+// InForce returns the version of history, ordered by version, that is in
+// force at t in valid time, or nil if none is. Later versions are
+// corrections and win over earlier ones.
+func InForce(history []Record, t time.Time) *Record {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].EffectiveAt(t) {
+			return &history[i]
+		}
+	}
+	return nil
+}
+
+// EffectiveSince returns, for each key, when in valid time the value it holds
+// at to took effect, no earlier than from. history is ordered by version and
+// holds the versions known at the time of interest; keys missing from the
+// data, or from a tombstone's, count as removed.
+func EffectiveSince(history []Record, keys []string, from, to time.Time) map[string]time.Time {
+	// The version in force only changes where a version starts or stops
+	// being effective.
+	starts := []time.Time{from}
+	for _, record := range history {
+		for _, t := range []*time.Time{&record.EffectiveFrom, record.EffectiveTo} {
+			if t != nil && t.After(from) && !t.After(to) {
+				starts = append(starts, *t)
+			}
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	since := make(map[string]time.Time, len(keys))
+	for _, key := range keys {
+		value, ok := valueAt(history, key, to)
+		since[key] = from
+		for i := len(starts) - 1; i > 0; i-- {
+			v, present := valueAt(history, key, starts[i-1])
+			if present != ok || !EqualValues(v, value) {
+				since[key] = starts[i]
+				break
+			}
+		}
+	}
+	return since
+}
+
+// valueAt returns the value of key in the version in force at t.
+func valueAt(history []Record, key string, t time.Time) (interface{}, bool) {
+	record := InForce(history, t)
+	if record == nil || record.Deleted {
+		return nil, false
+	}
+	value, ok := record.Data[key]
+	return value, ok
+}
@@ -4,25 +4,74 @@ import "time"
 
 // Record represents a versioned record in the system
 type Record struct {
-	ID        int               `json:"id"`
-	Data      map[string]string `json:"data"`
-	Version   int               `json:"version"`
-	CreatedAt time.Time         `json:"created_at"`
-	UpdatedAt time.Time         `json:"updated_at"`
+	// Collection is the collection the record belongs to. Ids and versions
+	// are only unique within a collection.
+	Collection string                 `json:"collection"`
+	ID         int                    `json:"id"`
+	Data       map[string]interface{} `json:"data"`
+	Version    int                    `json:"version"`
+	CreatedAt  time.Time              `json:"created_at"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+	// RecordedAt is the transaction time: when this version was written.
+	RecordedAt time.Time `json:"recorded_at"`
+	// EffectiveFrom and EffectiveTo bound the valid time of this version:
+	// the period in the real world the data describes. A nil EffectiveTo
+	// means the version is effective until further notice.
+	EffectiveFrom time.Time  `json:"effective_from"`
+	EffectiveTo   *time.Time `json:"effective_to,omitempty"`
+	// Deleted marks a tombstone: the version that deleted the record.
+	Deleted bool `json:"deleted,omitempty"`
+	// Author and Reason say who made this version and why.
+	Author string `json:"author,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// SchemaVersion is the version of the collection's schema the data was
+	// validated with, 0 if the collection had none.
+	SchemaVersion int `json:"schema_version,omitempty"`
 }
 
 // Copy creates a deep copy of the Record
 func (r *Record) Copy() Record {
-	newData := make(map[string]string, len(r.Data))
+	newData := make(map[string]interface{}, len(r.Data))
 	for key, value := range r.Data {
-		newData[key] = value
+		newData[key] = CopyValue(value)
+	}
+
+	var effectiveTo *time.Time
+	if r.EffectiveTo != nil {
+		t := *r.EffectiveTo
+		effectiveTo = &t
 	}
 
 	return Record{
-		ID:        r.ID,
-		Data:      newData,
-		Version:   r.Version,
-		CreatedAt: r.CreatedAt,
-		UpdatedAt: r.UpdatedAt,
+		Collection:    r.Collection,
+		ID:            r.ID,
+		Data:          newData,
+		Version:       r.Version,
+		CreatedAt:     r.CreatedAt,
+		UpdatedAt:     r.UpdatedAt,
+		RecordedAt:    r.RecordedAt,
+		EffectiveFrom: r.EffectiveFrom,
+		EffectiveTo:   effectiveTo,
+		Deleted:       r.Deleted,
+		Author:        r.Author,
+		Reason:        r.Reason,
+		SchemaVersion: r.SchemaVersion,
+	}
+}
+
+// VisibleData returns the record's data as readers see it. A tombstone keeps
+// the data it deleted only so that the record can be restored, so it has none.
+func (r *Record) VisibleData() map[string]interface{} {
+	if r.Deleted {
+		return map[string]interface{}{}
+	}
+	return r.Data
+}
+
+// EffectiveAt reports whether the version's valid time covers t.
+func (r *Record) EffectiveAt(t time.Time) bool {
+	if t.Before(r.EffectiveFrom) {
+		return false
 	}
+	return r.EffectiveTo == nil || t.Before(*r.EffectiveTo)
 }
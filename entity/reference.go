@@ -0,0 +1,23 @@
+package entity
+
+import "fmt"
+
+// ReferenceKey is the only key of the object that stands for a reference in
+// record data: {"$ref": "locations/3"}.
+const ReferenceKey = "$ref"
+
+// Reference links a record's data to another record, possibly in another
+// collection. The collection is the type of the record referenced.
+type Reference struct {
+	Collection string `json:"collection"`
+	ID         int    `json:"id"`
+}
+
+func (r Reference) String() string {
+	return fmt.Sprintf("%s/%d", r.Collection, r.ID)
+}
+
+// Value returns the reference as it is written in record data.
+func (r Reference) Value() map[string]interface{} {
+	return map[string]interface{}{ReferenceKey: r.String()}
+}
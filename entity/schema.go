@@ -0,0 +1,15 @@
+package entity
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Schema is a version of the JSON Schema that new versions of a collection's
+// records must satisfy.
+type Schema struct {
+	Collection string          `json:"collection"`
+	Version    int             `json:"version"`
+	Schema     json.RawMessage `json:"schema"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
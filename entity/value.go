@@ -0,0 +1,87 @@
+package entity
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// The values of a record's data are decoded JSON: string, json.Number, bool,
+// []interface{} and map[string]interface{}, with nil allowed inside arrays
+// and objects. Numbers are kept as json.Number so that they are stored
+// exactly as written.
+
+// UnmarshalData decodes a JSON object into record data.
+func UnmarshalData(b []byte) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// NormalizeData converts data built in Go, such as a map holding ints, to
+// the form UnmarshalData produces.
+func NormalizeData(data map[string]interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	normalized, err := UnmarshalData(b)
+	if err != nil {
+		return nil, err
+	}
+	if normalized == nil {
+		normalized = map[string]interface{}{}
+	}
+	return normalized, nil
+}
+
+// CopyValue returns a deep copy of a data value.
+func CopyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = CopyValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = CopyValue(item)
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+// EqualValues reports whether two data values are the same.
+func EqualValues(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// ValueString renders a data value as a string: strings as themselves,
+// numbers and booleans as written in JSON, and arrays and objects as JSON.
+func ValueString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case nil:
+		return ""
+	case bool:
+		return fmt.Sprint(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	}
+}
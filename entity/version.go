@@ -0,0 +1,23 @@
+package entity
+
+import "time"
+
+// VersionInfo describes a single version of a record without its data.
+type VersionInfo struct {
+	Version       int        `json:"version"`
+	CreatedAt     time.Time  `json:"created_at"`
+	RecordedAt    time.Time  `json:"recorded_at"`
+	EffectiveFrom time.Time  `json:"effective_from"`
+	EffectiveTo   *time.Time `json:"effective_to,omitempty"`
+	Deleted       bool       `json:"deleted,omitempty"`
+	Author        string     `json:"author,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+	SchemaVersion int        `json:"schema_version,omitempty"`
+	// Summary is a short human readable description of the change.
+	Summary string `json:"summary"`
+	// Size is the size in bytes of the version's data encoded as JSON.
+	Size int `json:"size"`
+	// KeysTouched lists, in order, the keys added, changed or removed
+	// relative to the previous version.
+	KeysTouched []string `json:"keys_touched"`
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rainbowmga/timetravel/api"
@@ -18,13 +22,7 @@ var testServer *httptest.Server
 
 func TestMain(m *testing.M) {
 	// Set up the test server
-	sqliteService, err := service.NewSQLiteRecordService("./test_records.db")
-	if err != nil {
-		fmt.Printf("Failed to create SQLite service: %v\n", err)
-		os.Exit(1)
-	}
-
-	apiHandler := api.NewAPI(sqliteService)
+	apiHandler := api.NewAPI(service.NewInMemoryRecordService())
 	router := mux.NewRouter()
 	apiHandler.CreateRoutes(router)
 
@@ -32,11 +30,7 @@ func TestMain(m *testing.M) {
 	defer testServer.Close()
 
 	// Run the tests
-	code := m.Run()
-
-	// Clean up
-	os.Remove("./test_records.db")
-	os.Exit(code)
+	os.Exit(m.Run())
 }
 
 // V1 API Tests
@@ -137,6 +131,59 @@ func TestGetNonExistentRecordV1(t *testing.T) {
 	}
 }
 
+// TestGetRecordV1Golden checks that v1 responses for a database written by
+// the first release are unchanged on a server outside UTC.
+func TestGetRecordV1Golden(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("PST", -8*60*60)
+	defer func() { time.Local = local }()
+
+	path := filepath.Join(t.TempDir(), "records.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = db.Exec(`
+        CREATE TABLE records (
+            id INTEGER,
+            version INTEGER,
+            data TEXT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (id, version)
+        );
+        INSERT INTO records (id, version, data, created_at, updated_at) VALUES
+            (1, 1, '{"name":"Acme"}', '2024-01-02 15:47:44.123456789-08:00', '2024-01-02 15:47:44.123456789-08:00'),
+            (1, 2, '{"name":"Acme Inc"}', '2024-01-02 15:47:44.123456789-08:00', '2024-01-03 09:00:00-08:00');
+    `)
+	db.Close()
+	if err != nil {
+		t.Fatalf("Failed to seed database: %v", err)
+	}
+
+	sqliteService, err := service.NewSQLiteRecordService(path)
+	if err != nil {
+		t.Fatalf("Failed to create SQLite service: %v", err)
+	}
+	defer sqliteService.Close()
+	router := mux.NewRouter()
+	api.NewAPI(sqliteService).CreateRoutes(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/v1/records/1")
+	if err != nil {
+		t.Fatalf("Failed to get record: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	want := `{"id":1,"data":{"name":"Acme Inc"},"version":2,"created_at":"2024-01-02T15:47:44.123456789-08:00","updated_at":"2024-01-03T09:00:00-08:00"}` + "\n"
+	if string(body) != want {
+		t.Errorf("Expected the first release's response\n%s got\n%s", want, body)
+	}
+}
+
 // V2 API Tests
 
 func TestCreateRecordV2(t *testing.T) {
@@ -250,3 +297,1207 @@ func TestGetRecordVersionsV2(t *testing.T) {
 		t.Errorf("Expected versions [1, 2]; got %v", result)
 	}
 }
+
+func TestBitemporalRecordV2(t *testing.T) {
+	post := func(query string, payload map[string]string) {
+		body, _ := json.Marshal(payload)
+		resp, err := http.Post(testServer.URL+"/api/v2/records/10"+query, "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to post record: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status OK; got %v", resp.Status)
+		}
+	}
+	get := func(query string) map[string]interface{} {
+		resp, err := http.Get(testServer.URL + "/api/v2/records/10" + query)
+		if err != nil {
+			t.Fatalf("Failed to get record: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status OK for %s; got %v", query, resp.Status)
+		}
+		var result map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return result
+	}
+
+	post("?effective_from=2024-01-01T00:00:00Z", map[string]string{"address": "1 Old Road"})
+	beforeCorrection := time.Now().UTC().Format(time.RFC3339Nano)
+	// The address changed in March but we only learn about it now.
+	post("?effective_from=2024-03-01T00:00:00Z", map[string]string{"address": "2 New Street"})
+
+	cases := []struct {
+		query   string
+		address string
+	}{
+		{"?effective_at=2024-02-01T00:00:00Z", "1 Old Road"},
+		{"?effective_at=2024-04-01T00:00:00Z", "2 New Street"},
+		{"?effective_at=2024-04-01T00:00:00Z&known_at=" + beforeCorrection, "1 Old Road"},
+	}
+	for _, c := range cases {
+		data := get(c.query)["data"].(map[string]interface{})
+		if data["address"] != c.address {
+			t.Errorf("Expected address %q for %s; got %v", c.address, c.query, data["address"])
+		}
+	}
+
+	resp, err := http.Get(testServer.URL + "/api/v2/records/10?effective_at=2023-01-01T00:00:00Z")
+	if err != nil {
+		t.Fatalf("Failed to get record: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request before the record was effective; got %v", resp.Status)
+	}
+}
+
+func TestGetRecordAsOfV2(t *testing.T) {
+	beforeCreate := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, email := range []string{"first@example.com", "second@example.com"} {
+		body, _ := json.Marshal(map[string]string{"email": email})
+		resp, err := http.Post(testServer.URL+"/api/v2/records/11", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to post record: %v", err)
+		}
+		resp.Body.Close()
+	}
+	afterUpdates := time.Now().UTC().Format(time.RFC3339Nano)
+
+	resp, err := http.Get(testServer.URL + "/api/v2/records/11?as_of=" + afterUpdates)
+	if err != nil {
+		t.Fatalf("Failed to get record as of: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result["version"] != float64(2) {
+		t.Errorf("Expected version 2; got %v", result["version"])
+	}
+
+	resp, err = http.Get(testServer.URL + "/api/v2/records/11?as_of=" + beforeCreate)
+	if err != nil {
+		t.Fatalf("Failed to get record as of: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var errResult map[string]string
+	json.NewDecoder(resp.Body).Decode(&errResult)
+	if resp.StatusCode != http.StatusBadRequest || errResult["error"] == "" {
+		t.Errorf("Expected a Bad Request error before the record existed; got %v %v", resp.Status, errResult)
+	}
+}
+
+func TestGetRecordVersionsFullV2(t *testing.T) {
+	resp, err := http.Get(testServer.URL + "/api/v2/records/2/versions?format=full")
+	if err != nil {
+		t.Fatalf("Failed to get record versions: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status OK; got %v", resp.Status)
+	}
+
+	var result []map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 versions; got %v", len(result))
+	}
+	if result[1]["version"] != float64(2) {
+		t.Errorf("Expected version 2; got %v", result[1]["version"])
+	}
+	keys := result[1]["keys_touched"].([]interface{})
+	if len(keys) != 1 || keys[0] != "email" {
+		t.Errorf("Expected keys_touched [email]; got %v", keys)
+	}
+	if result[1]["summary"] != "changed email" {
+		t.Errorf("Expected summary %q; got %v", "changed email", result[1]["summary"])
+	}
+}
+
+func TestGetRecordDiffV2(t *testing.T) {
+	payloads := []map[string]*string{
+		{"name": strPtr("Acme"), "state": strPtr("NY"), "phone": strPtr("555")},
+		{"state": strPtr("CA"), "phone": nil, "employees": strPtr("12")},
+	}
+	for _, payload := range payloads {
+		body, _ := json.Marshal(payload)
+		resp, err := http.Post(testServer.URL+"/api/v2/records/12", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to post record: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(testServer.URL + "/api/v2/records/12/diff?from=1&to=2")
+	if err != nil {
+		t.Fatalf("Failed to get diff: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", resp.Status)
+	}
+
+	var result struct {
+		Added   map[string]string            `json:"added"`
+		Removed map[string]string            `json:"removed"`
+		Changed map[string]map[string]string `json:"changed"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result.Added["employees"] != "12" || len(result.Added) != 1 {
+		t.Errorf("Expected employees to be added; got %v", result.Added)
+	}
+	if result.Removed["phone"] != "555" || len(result.Removed) != 1 {
+		t.Errorf("Expected phone to be removed; got %v", result.Removed)
+	}
+	if result.Changed["state"]["before"] != "NY" || result.Changed["state"]["after"] != "CA" || len(result.Changed) != 1 {
+		t.Errorf("Expected state to change from NY to CA; got %v", result.Changed)
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestGetRecordTimeDiffV2(t *testing.T) {
+	// Record 10 moved address on 2024-03-01, see TestBitemporalRecordV2.
+	resp, err := http.Get(testServer.URL + "/api/v2/records/10/diff?from_time=2024-01-15T00:00:00Z&to_time=2024-07-01T00:00:00Z")
+	if err != nil {
+		t.Fatalf("Failed to get diff: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", resp.Status)
+	}
+
+	var result struct {
+		From    int                          `json:"from"`
+		To      int                          `json:"to"`
+		Changed map[string]map[string]string `json:"changed"`
+		Window  struct {
+			From time.Time `json:"from"`
+			To   time.Time `json:"to"`
+		} `json:"window"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result.From != 1 || result.To != 2 {
+		t.Errorf("Expected diff from version 1 to 2; got %v to %v", result.From, result.To)
+	}
+	if result.Changed["address"]["after"] != "2 New Street" {
+		t.Errorf("Expected address change; got %v", result.Changed)
+	}
+	if !result.Window.From.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected window to start 2024-03-01; got %v", result.Window.From)
+	}
+	if !result.Window.To.Equal(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected window to end 2024-07-01; got %v", result.Window.To)
+	}
+}
+
+func TestGetRecordTimeDiffWindowsV2(t *testing.T) {
+	for _, write := range []struct {
+		effectiveFrom string
+		data          map[string]string
+	}{
+		{"2024-01-01T00:00:00Z", map[string]string{"address": "1 Old Road", "employees": "10"}},
+		{"2024-03-01T00:00:00Z", map[string]string{"address": "2 New Street"}},
+		{"2024-05-01T00:00:00Z", map[string]string{"employees": "20"}},
+	} {
+		body, _ := json.Marshal(write.data)
+		resp, err := http.Post(testServer.URL+"/api/v2/records/18?effective_from="+write.effectiveFrom, "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to update record: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(testServer.URL + "/api/v2/records/18/diff?from_time=2024-01-15T00:00:00Z&to_time=2024-07-01T00:00:00Z")
+	if err != nil {
+		t.Fatalf("Failed to get diff: %v", err)
+	}
+	defer resp.Body.Close()
+
+	type window struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	}
+	var result struct {
+		Window  window            `json:"window"`
+		Windows map[string]window `json:"windows"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	march := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	may := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	if !result.Window.From.Equal(march) {
+		t.Errorf("Expected the window to start with the address change on 2024-03-01; got %v", result.Window.From)
+	}
+	if !result.Windows["address"].From.Equal(march) || !result.Windows["employees"].From.Equal(may) {
+		t.Errorf("Expected address from 2024-03-01 and employees from 2024-05-01; got %+v", result.Windows)
+	}
+}
+
+func TestConcurrentUpdatesV2(t *testing.T) {
+	body, _ := json.Marshal(map[string]string{"counter": "0"})
+	resp, err := http.Post(testServer.URL+"/api/v2/records/13", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	resp.Body.Close()
+
+	const writers = 10
+	statuses := make(chan int, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			body, _ := json.Marshal(map[string]string{"counter": fmt.Sprint(i + 1)})
+			resp, err := http.Post(testServer.URL+"/api/v2/records/13", "application/json", bytes.NewBuffer(body))
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}(i)
+	}
+	for i := 0; i < writers; i++ {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("Expected every concurrent update to succeed; got status %v", status)
+		}
+	}
+
+	resp, err = http.Get(testServer.URL + "/api/v2/records/13")
+	if err != nil {
+		t.Fatalf("Failed to get record: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result["version"] != float64(writers+1) {
+		t.Errorf("Expected version %d; got %v", writers+1, result["version"])
+	}
+}
+
+func TestUpdateVersionConflictV2(t *testing.T) {
+	update := func(ifMatch string) *http.Response {
+		body, _ := json.Marshal(map[string]string{"status": "active"})
+		req, _ := http.NewRequest("POST", testServer.URL+"/api/v2/records/13", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", ifMatch)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to update record: %v", err)
+		}
+		return resp
+	}
+
+	resp := update(`"1"`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected status Conflict; got %v", resp.Status)
+	}
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	current, ok := result["current_version"].(float64)
+	if !ok || current <= 1 {
+		t.Fatalf("Expected current_version in the conflict response; got %v", result)
+	}
+
+	resp = update(fmt.Sprintf(`"%d"`, int(current)))
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status OK with the current version; got %v", resp.Status)
+	}
+	if resp.Header.Get("ETag") != fmt.Sprintf(`"%d"`, int(current)+1) {
+		t.Errorf("Expected ETag of the new version; got %v", resp.Header.Get("ETag"))
+	}
+}
+
+func TestExpectedVersionInBodyV2(t *testing.T) {
+	post := func(data map[string]interface{}, ifMatch string) *http.Response {
+		body, _ := json.Marshal(data)
+		req, _ := http.NewRequest("POST", testServer.URL+"/api/v2/records/19", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to write record: %v", err)
+		}
+		return resp
+	}
+
+	// If-Match: * only matches a record that exists.
+	resp := post(map[string]interface{}{"status": "new"}, "*")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected status Precondition Failed for a missing record; got %v", resp.Status)
+	}
+
+	resp = post(map[string]interface{}{"status": "new"}, "")
+	resp.Body.Close()
+
+	resp = post(map[string]interface{}{"status": "stale", "expected_version": 2}, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status Conflict for a stale expected_version; got %v", resp.Status)
+	}
+
+	resp = post(map[string]interface{}{"status": "active", "expected_version": 1}, "*")
+	defer resp.Body.Close()
+	var result struct {
+		Version int                    `json:"version"`
+		Data    map[string]interface{} `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK || result.Version != 2 {
+		t.Errorf("Expected version 2; got %v %+v", resp.Status, result)
+	}
+	if _, ok := result.Data["expected_version"]; ok || result.Data["status"] != "active" {
+		t.Errorf("Expected expected_version not to be stored; got %v", result.Data)
+	}
+
+	resp = post(map[string]interface{}{"status": "active", "expected_version": 2}, `"1"`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request when If-Match and expected_version disagree; got %v", resp.Status)
+	}
+}
+
+func TestConcurrentCreateV1AndV2(t *testing.T) {
+	const writers = 10
+	statuses := make(chan int, writers)
+	for i := 0; i < writers; i++ {
+		api := "v1"
+		if i%2 == 1 {
+			api = "v2"
+		}
+		go func(api string) {
+			body, _ := json.Marshal(map[string]string{"source": api})
+			resp, err := http.Post(testServer.URL+"/api/"+api+"/records/14", "application/json", bytes.NewBuffer(body))
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}(api)
+	}
+	for i := 0; i < writers; i++ {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("Expected every concurrent create to succeed; got status %v", status)
+		}
+	}
+
+	resp, err := http.Get(testServer.URL + "/api/v2/records/14/versions")
+	if err != nil {
+		t.Fatalf("Failed to get record versions: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var versions []int
+	json.NewDecoder(resp.Body).Decode(&versions)
+	if len(versions) != writers {
+		t.Errorf("Expected %d versions; got %v", writers, versions)
+	}
+}
+
+func TestDeleteAndRestoreRecordV2(t *testing.T) {
+	body, _ := json.Marshal(map[string]string{"policy": "active"})
+	resp, err := http.Post(testServer.URL+"/api/v2/records/15", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	resp.Body.Close()
+
+	req, _ := http.NewRequest("DELETE", testServer.URL+"/api/v2/records/15", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to delete record: %v", err)
+	}
+	// A deleted version has no data.
+	var tombstone struct {
+		Deleted bool                   `json:"deleted"`
+		Data    map[string]interface{} `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&tombstone)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !tombstone.Deleted || len(tombstone.Data) != 0 {
+		t.Errorf("Expected status OK with a tombstone without data; got %v %+v", resp.Status, tombstone)
+	}
+
+	resp, err = http.Get(testServer.URL + "/api/v2/records/15?version=2")
+	if err != nil {
+		t.Fatalf("Failed to get record version: %v", err)
+	}
+	tombstone.Data = nil
+	json.NewDecoder(resp.Body).Decode(&tombstone)
+	resp.Body.Close()
+	if !tombstone.Deleted || len(tombstone.Data) != 0 {
+		t.Errorf("Expected version 2 to be a tombstone without data; got %+v", tombstone)
+	}
+
+	resp, err = http.Get(testServer.URL + "/api/v2/records/15")
+	if err != nil {
+		t.Fatalf("Failed to get record: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request for a deleted record; got %v", resp.Status)
+	}
+
+	// A delete removes every key.
+	resp, err = http.Get(testServer.URL + "/api/v2/records/15/diff?from=1&to=2")
+	if err != nil {
+		t.Fatalf("Failed to get diff: %v", err)
+	}
+	var diff struct {
+		Removed map[string]string `json:"removed"`
+	}
+	json.NewDecoder(resp.Body).Decode(&diff)
+	resp.Body.Close()
+	if diff.Removed["policy"] != "active" {
+		t.Errorf("Expected the delete to remove policy; got %+v", diff)
+	}
+
+	resp, err = http.Get(testServer.URL + "/api/v2/records/15?version=1")
+	if err != nil {
+		t.Fatalf("Failed to get record version: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected history to stay readable; got %v", resp.Status)
+	}
+
+	resp, err = http.Post(testServer.URL+"/api/v2/records/15/restore", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Failed to restore record: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result["version"] != float64(3) {
+		t.Errorf("Expected version 3; got %v", result["version"])
+	}
+	data := result["data"].(map[string]interface{})
+	if data["policy"] != "active" {
+		t.Errorf("Expected restored data; got %v", data)
+	}
+}
+
+func TestRevertRecordV2(t *testing.T) {
+	// Record 12 went from {name, state: NY, phone} to {name, state: CA, employees}.
+	resp, err := http.Post(testServer.URL+"/api/v2/records/12/revert?to=1", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Failed to revert record: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", resp.Status)
+	}
+
+	var result struct {
+		Version int               `json:"version"`
+		Data    map[string]string `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result.Version != 3 {
+		t.Errorf("Expected version 3; got %v", result.Version)
+	}
+	want := map[string]string{"name": "Acme", "state": "NY", "phone": "555"}
+	if fmt.Sprint(result.Data) != fmt.Sprint(want) {
+		t.Errorf("Expected data %v; got %v", want, result.Data)
+	}
+}
+
+func TestAuthorAndReasonV2(t *testing.T) {
+	body, _ := json.Marshal(map[string]string{"address": "3 Audit Lane"})
+	req, _ := http.NewRequest("POST", testServer.URL+"/api/v2/records/16", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Actor", "adjuster@example.com")
+	req.Header.Set("X-Change-Reason", "customer called in")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(testServer.URL + "/api/v2/records/16")
+	if err != nil {
+		t.Fatalf("Failed to get record: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result["author"] != "adjuster@example.com" || result["reason"] != "customer called in" {
+		t.Errorf("Expected author and reason on the record; got %v", result)
+	}
+
+	resp, err = http.Get(testServer.URL + "/api/v2/records/16/versions?format=full")
+	if err != nil {
+		t.Fatalf("Failed to get record versions: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var versions []map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&versions)
+	if len(versions) != 1 || versions[0]["author"] != "adjuster@example.com" {
+		t.Errorf("Expected author in the version descriptors; got %v", versions)
+	}
+}
+
+func TestFieldHistoryV2(t *testing.T) {
+	// Record 12 set state to NY, then CA, then was reverted to NY.
+	resp, err := http.Get(testServer.URL + "/api/v2/records/12/fields/state/history")
+	if err != nil {
+		t.Fatalf("Failed to get field history: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v", resp.Status)
+	}
+
+	var spans []struct {
+		Value       *string `json:"value"`
+		FromVersion int     `json:"from_version"`
+		ToVersion   *int    `json:"to_version"`
+	}
+	json.NewDecoder(resp.Body).Decode(&spans)
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans; got %v", len(spans))
+	}
+	for i, want := range []string{"NY", "CA", "NY"} {
+		if spans[i].Value == nil || *spans[i].Value != want || spans[i].FromVersion != i+1 {
+			t.Errorf("Expected span %d to hold %q from version %d; got %+v", i, want, i+1, spans[i])
+		}
+	}
+	if spans[0].ToVersion == nil || *spans[0].ToVersion != 1 || spans[2].ToVersion != nil {
+		t.Errorf("Expected closed spans to end at their last version and the current one to be open")
+	}
+
+	resp, err = http.Get(testServer.URL + "/api/v2/records/12/fields/missing/history")
+	if err != nil {
+		t.Fatalf("Failed to get field history: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request for a key that was never set; got %v", resp.Status)
+	}
+}
+
+func TestRecordBlameV2(t *testing.T) {
+	blame := func(query string) map[string]struct {
+		Value   string `json:"value"`
+		Version int    `json:"version"`
+	} {
+		resp, err := http.Get(testServer.URL + "/api/v2/records/12/blame" + query)
+		if err != nil {
+			t.Fatalf("Failed to get blame: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status OK; got %v", resp.Status)
+		}
+
+		var result struct {
+			Fields map[string]struct {
+				Value   string `json:"value"`
+				Version int    `json:"version"`
+			} `json:"fields"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return result.Fields
+	}
+
+	// Record 12: v1 {name, state: NY, phone}, v2 {name, state: CA, employees}, v3 reverted to v1.
+	latest := blame("")
+	for key, version := range map[string]int{"name": 1, "state": 3, "phone": 3} {
+		if latest[key].Version != version {
+			t.Errorf("Expected %s to be blamed on version %d; got %+v", key, version, latest[key])
+		}
+	}
+
+	second := blame("?version=2")
+	for key, version := range map[string]int{"name": 1, "state": 2, "employees": 2} {
+		if second[key].Version != version {
+			t.Errorf("Expected %s at version 2 to be blamed on version %d; got %+v", key, version, second[key])
+		}
+	}
+	if len(second) != 3 {
+		t.Errorf("Expected 3 keys at version 2; got %v", second)
+	}
+}
+
+func TestListRecordsV2(t *testing.T) {
+	seen := map[int]bool{}
+	last := 0
+	url := testServer.URL + "/api/v2/records?limit=3"
+	for {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("Failed to list records: %v", err)
+		}
+
+		var page struct {
+			Records []struct {
+				ID int `json:"id"`
+			} `json:"records"`
+			NextCursor string `json:"next_cursor"`
+		}
+		json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status OK; got %v", resp.Status)
+		}
+		if len(page.Records) > 3 {
+			t.Fatalf("Expected at most 3 records per page; got %v", len(page.Records))
+		}
+		for _, record := range page.Records {
+			if record.ID <= last || seen[record.ID] {
+				t.Fatalf("Expected ids in increasing order without repeats; got %v after %v", record.ID, last)
+			}
+			seen[record.ID] = true
+			last = record.ID
+		}
+
+		if page.NextCursor == "" {
+			break
+		}
+		url = testServer.URL + "/api/v2/records?limit=3&cursor=" + page.NextCursor
+	}
+
+	for _, id := range []int{1, 2, 10} {
+		if !seen[id] {
+			t.Errorf("Expected record %d to be listed", id)
+		}
+	}
+}
+
+func TestListRecordsWhereV2(t *testing.T) {
+	// Record 12 was reverted to {name: Acme, state: NY, phone: 555}.
+	resp, err := http.Get(testServer.URL + "/api/v2/records?where=state:eq:NY&where=phone:gte:500")
+	if err != nil {
+		t.Fatalf("Failed to list records: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var page struct {
+		Records []struct {
+			ID int `json:"id"`
+		} `json:"records"`
+	}
+	json.NewDecoder(resp.Body).Decode(&page)
+	if len(page.Records) != 1 || page.Records[0].ID != 12 {
+		t.Errorf("Expected only record 12; got %v", page.Records)
+	}
+
+	resp, err = http.Get(testServer.URL + "/api/v2/records?where=state:like:NY")
+	if err != nil {
+		t.Fatalf("Failed to list records: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request for an unknown operator; got %v", resp.Status)
+	}
+}
+
+func TestIndexesV2(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPut, testServer.URL+"/api/v2/admin/indexes/state", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to add index: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected status Not Implemented from the in-memory service; got %v", resp.Status)
+	}
+
+	sqliteService, err := service.NewSQLiteRecordService(filepath.Join(t.TempDir(), "records.db"))
+	if err != nil {
+		t.Fatalf("Failed to create SQLite service: %v", err)
+	}
+	defer sqliteService.Close()
+	router := mux.NewRouter()
+	api.NewAPI(sqliteService).CreateRoutes(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	req, _ = http.NewRequest(http.MethodPut, server.URL+"/api/v2/admin/indexes/state", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to add index: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status OK; got %v", resp.Status)
+	}
+
+	resp, err = http.Post(server.URL+"/api/v2/admin/indexes/rebuild", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Failed to rebuild indexes: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status OK; got %v", resp.Status)
+	}
+
+	resp, err = http.Get(server.URL + "/api/v2/admin/indexes")
+	if err != nil {
+		t.Fatalf("Failed to list indexes: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Keys []string `json:"keys"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if len(result.Keys) != 1 || result.Keys[0] != "state" {
+		t.Errorf("Expected indexed keys [state]; got %v", result.Keys)
+	}
+}
+
+func TestSearchRecordsV2(t *testing.T) {
+	// Record 16 was created with {address: 3 Audit Lane}.
+	resp, err := http.Get(testServer.URL + "/api/v2/search?q=audit+lane")
+	if err != nil {
+		t.Fatalf("Failed to search records: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Records []struct {
+			ID int `json:"id"`
+		} `json:"records"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if len(result.Records) != 1 || result.Records[0].ID != 16 {
+		t.Errorf("Expected only record 16; got %v", result.Records)
+	}
+
+	resp, err = http.Get(testServer.URL + "/api/v2/search?q=")
+	if err != nil {
+		t.Fatalf("Failed to search records: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request for an empty query; got %v", resp.Status)
+	}
+}
+
+func TestTypedValuesV2(t *testing.T) {
+	body := []byte(`{"employees":12,"active":true,"address":{"city":"Oakland"},"note":null}`)
+	resp, err := http.Post(testServer.URL+"/api/v2/records/17", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result.Data["employees"] != float64(12) || result.Data["active"] != true {
+		t.Errorf("Expected typed values; got %v", result.Data)
+	}
+	if address, ok := result.Data["address"].(map[string]interface{}); !ok || address["city"] != "Oakland" {
+		t.Errorf("Expected a nested address; got %v", result.Data["address"])
+	}
+	if _, ok := result.Data["note"]; ok {
+		t.Errorf("Expected null to leave note unset; got %v", result.Data["note"])
+	}
+
+	// v1 clients keep seeing strings.
+	resp, err = http.Get(testServer.URL + "/api/v1/records/17")
+	if err != nil {
+		t.Fatalf("Failed to get record: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var resultV1 struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&resultV1); err != nil {
+		t.Fatalf("Expected string data from v1: %v", err)
+	}
+	want := map[string]string{"employees": "12", "active": "true", "address": `{"city":"Oakland"}`}
+	if fmt.Sprint(resultV1.Data) != fmt.Sprint(want) {
+		t.Errorf("Expected %v; got %v", want, resultV1.Data)
+	}
+
+	resp, err = http.Post(testServer.URL+"/api/v1/records/17", "application/json", bytes.NewBufferString(`{"employees":13}`))
+	if err != nil {
+		t.Fatalf("Failed to update record: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request for a number sent to v1; got %v", resp.Status)
+	}
+}
+
+func TestMergePatchV2(t *testing.T) {
+	// Record 17 holds {employees: 12, active: true, address: {city: Oakland}}.
+	body := bytes.NewBufferString(`{"address":{"zip":"94607","city":null},"active":null}`)
+	req, _ := http.NewRequest("PATCH", testServer.URL+"/api/v2/records/17", body)
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to patch record: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status OK; got %v", resp.Status)
+	}
+
+	var result struct {
+		Version int                    `json:"version"`
+		Data    map[string]interface{} `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result.Version != 2 {
+		t.Errorf("Expected a single new version 2; got %d", result.Version)
+	}
+	want := `map[address:map[zip:94607] employees:12]`
+	if fmt.Sprint(result.Data) != want {
+		t.Errorf("Expected %s; got %v", want, result.Data)
+	}
+}
+
+func TestJSONPatchV2(t *testing.T) {
+	// Record 17 holds {employees: 12, address: {zip: 94607}} at version 2.
+	patch := func(body string) *http.Response {
+		req, _ := http.NewRequest("PATCH", testServer.URL+"/api/v2/records/17", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json-patch+json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to patch record: %v", err)
+		}
+		return resp
+	}
+
+	resp := patch(`[{"op":"test","path":"/employees","value":11},{"op":"remove","path":"/address"}]`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status Conflict for a failed test; got %v", resp.Status)
+	}
+
+	resp = patch(`[{"op":"test","path":"/employees","value":12},{"op":"remove","path":"/address"}]`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status OK; got %v", resp.Status)
+	}
+
+	var result struct {
+		Version int                    `json:"version"`
+		Data    map[string]interface{} `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result.Version != 3 || fmt.Sprint(result.Data) != "map[employees:12]" {
+		t.Errorf("Expected version 3 without the address; got version %d with %v", result.Version, result.Data)
+	}
+
+	resp = patch(`{"op":"remove","path":"/employees"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request for a patch that is not a list; got %v", resp.Status)
+	}
+}
+
+func TestCollectionsV2(t *testing.T) {
+	body, _ := json.Marshal(map[string]string{"policy": "GL-1"})
+	resp, err := http.Post(testServer.URL+"/api/v2/policies/1", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Collection string            `json:"collection"`
+		Version    int               `json:"version"`
+		Data       map[string]string `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result.Collection != "policies" || result.Version != 1 {
+		t.Errorf("Expected version 1 in policies; got version %d in %q", result.Version, result.Collection)
+	}
+
+	// Record 1 of the default collection is unaffected.
+	resp, err = http.Get(testServer.URL + "/api/v2/records/1")
+	if err != nil {
+		t.Fatalf("Failed to get record: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var other struct {
+		Collection string            `json:"collection"`
+		Data       map[string]string `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&other)
+	if other.Collection != "records" || other.Data["policy"] != "" {
+		t.Errorf("Expected record 1 of records; got %+v", other)
+	}
+
+	resp, err = http.Get(testServer.URL + "/api/v2/admin/collections")
+	if err != nil {
+		t.Fatalf("Failed to list collections: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var collections struct {
+		Collections []string `json:"collections"`
+	}
+	json.NewDecoder(resp.Body).Decode(&collections)
+	if fmt.Sprint(collections.Collections) != "[policies records]" {
+		t.Errorf("Expected collections [policies records]; got %v", collections.Collections)
+	}
+
+	for _, url := range []string{"/api/v2/Policies/1", "/api/v2/admin/1"} {
+		resp, err = http.Get(testServer.URL + url)
+		if err != nil {
+			t.Fatalf("Failed to get record: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request for %s; got %v", url, resp.Status)
+		}
+	}
+}
+
+func TestSchemaV2(t *testing.T) {
+	schema := `{"type": "object", "required": ["claimant"], "properties": {"amount": {"type": "number", "minimum": 0}}}`
+	req, _ := http.NewRequest(http.MethodPut, testServer.URL+"/api/v2/admin/collections/claims/schema", bytes.NewBufferString(schema))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to set schema: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var registered struct {
+		Collection string          `json:"collection"`
+		Version    int             `json:"version"`
+		Schema     json.RawMessage `json:"schema"`
+	}
+	json.NewDecoder(resp.Body).Decode(&registered)
+	if resp.StatusCode != http.StatusOK || registered.Collection != "claims" || registered.Version != 1 {
+		t.Errorf("Expected schema version 1 of claims; got %v %+v", resp.Status, registered)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"amount": -5})
+	resp, err = http.Post(testServer.URL+"/api/v2/claims/1", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var invalid struct {
+		SchemaVersion int `json:"schema_version"`
+		Errors        []struct {
+			Path    string `json:"path"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	json.NewDecoder(resp.Body).Decode(&invalid)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request; got %v", resp.Status)
+	}
+	if invalid.SchemaVersion != 1 || len(invalid.Errors) != 2 || invalid.Errors[0].Path != "/claimant" || invalid.Errors[1].Path != "/amount" {
+		t.Errorf("Expected errors for /claimant and /amount from schema version 1; got %+v", invalid)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{"claimant": "Acme", "amount": 5})
+	resp, err = http.Post(testServer.URL+"/api/v2/claims/1", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to create record: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Version       int `json:"version"`
+		SchemaVersion int `json:"schema_version"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK || result.Version != 1 || result.SchemaVersion != 1 {
+		t.Errorf("Expected version 1 validated with schema version 1; got %v %+v", resp.Status, result)
+	}
+
+	resp, err = http.Get(testServer.URL + "/api/v2/admin/collections/claims/schema?version=1")
+	if err != nil {
+		t.Fatalf("Failed to get schema: %v", err)
+	}
+	defer resp.Body.Close()
+
+	registered.Schema = nil
+	json.NewDecoder(resp.Body).Decode(&registered)
+	var compacted bytes.Buffer
+	json.Compact(&compacted, []byte(schema))
+	if resp.StatusCode != http.StatusOK || string(registered.Schema) != compacted.String() {
+		t.Errorf("Expected the registered schema; got %v %s", resp.Status, registered.Schema)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, testServer.URL+"/api/v2/admin/collections/claims/schema", bytes.NewBufferString(`{"type": "objekt"}`))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to set schema: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request for an invalid schema; got %v", resp.Status)
+	}
+}
+
+func TestExpandReferencesV2(t *testing.T) {
+	for _, write := range []struct {
+		url  string
+		data map[string]interface{}
+	}{
+		{"/api/v2/locations/1", map[string]interface{}{"city": "Austin"}},
+		{"/api/v2/policies/2", map[string]interface{}{"number": "GL-2", "location": map[string]string{"$ref": "locations/1"}}},
+		{"/api/v2/locations/1", map[string]interface{}{"city": "Dallas"}},
+	} {
+		body, _ := json.Marshal(write.data)
+		resp, err := http.Post(testServer.URL+write.url, "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to write record: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status OK for %s; got %v", write.url, resp.Status)
+		}
+	}
+
+	for query, city := range map[string]string{"expand=location": "Dallas", "version=1&expand=location": "Austin"} {
+		resp, err := http.Get(testServer.URL + "/api/v2/policies/2?" + query)
+		if err != nil {
+			t.Fatalf("Failed to get record: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var result struct {
+			ID       int `json:"id"`
+			Expanded struct {
+				Location struct {
+					Collection string            `json:"collection"`
+					Data       map[string]string `json:"data"`
+				} `json:"location"`
+			} `json:"expanded"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		if location := result.Expanded.Location; result.ID != 2 || location.Collection != "locations" || location.Data["city"] != city {
+			t.Errorf("Expected location in %s for %s; got %+v", city, query, result)
+		}
+	}
+
+	resp, err := http.Get(testServer.URL + "/api/v2/policies/2?expand=number")
+	if err != nil {
+		t.Fatalf("Failed to get record: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request expanding a value that is not a reference; got %v", resp.Status)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"location": map[string]string{"$ref": "locations"}})
+	resp, err = http.Post(testServer.URL+"/api/v2/policies/3", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request for an invalid reference; got %v", resp.Status)
+	}
+}
+
+func TestSnapshotV2(t *testing.T) {
+	quarterEnd := time.Now().UTC().Format(time.RFC3339Nano)
+
+	body, _ := json.Marshal(map[string]string{"city": "Houston"})
+	resp, err := http.Post(testServer.URL+"/api/v2/locations/1", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to update record: %v", err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(testServer.URL + "/api/v2/snapshot?as_of=" + quarterEnd)
+	if err != nil {
+		t.Fatalf("Failed to get snapshot: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Expected status OK with NDJSON; got %v %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	cities := map[int]string{}
+	count := 0
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		var record struct {
+			Collection string                 `json:"collection"`
+			ID         int                    `json:"id"`
+			Data       map[string]interface{} `json:"data"`
+		}
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatalf("Failed to decode snapshot: %v", err)
+		}
+		if record.Collection == "locations" {
+			cities[record.ID], _ = record.Data["city"].(string)
+		}
+		count++
+	}
+	if cities[1] != "Dallas" || count < 2 {
+		t.Errorf("Expected locations/1 in Dallas among the records at %s; got %v in %d records", quarterEnd, cities, count)
+	}
+
+	for _, url := range []string{"/api/v2/snapshot?as_of=yesterday", "/api/v2/snapshot/1"} {
+		resp, err = http.Get(testServer.URL + url)
+		if err != nil {
+			t.Fatalf("Failed to get snapshot: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request for %s; got %v", url, resp.Status)
+		}
+	}
+}
+
+func TestSnapshotOutlastsWriteTimeoutV2(t *testing.T) {
+	router := mux.NewRouter()
+	api.NewAPI(service.NewInMemoryRecordService()).CreateRoutes(router)
+	// Every request takes longer than the write timeout before it is handled.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		router.ServeHTTP(w, r)
+	}))
+	server.Config.WriteTimeout = 50 * time.Millisecond
+	server.Config.ConnContext = api.ConnContext
+	server.Start()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	if resp, err := client.Get(server.URL + "/api/v2/records"); err == nil {
+		resp.Body.Close()
+		t.Fatalf("Expected listing records to exceed the write timeout; got %v", resp.Status)
+	}
+
+	resp, err := client.Get(server.URL + "/api/v2/snapshot")
+	if err != nil {
+		t.Fatalf("Failed to get snapshot: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status OK; got %v", resp.Status)
+	}
+}
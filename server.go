@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -18,13 +21,36 @@ func logError(err error) {
 }
 
 func main() {
+	dbPath := flag.String("db", "./records.db", "path of the SQLite database")
+	indexKeys := flag.String("index", "", "comma-separated record keys to index")
+	rebuildIndexes := flag.Bool("rebuild-indexes", false, "rebuild the record indexes and exit")
+	flag.Parse()
+
 	router := mux.NewRouter()
 
-	sqliteService, err := service.NewSQLiteRecordService("./records.db")
+	sqliteService, err := service.NewSQLiteRecordService(*dbPath)
 	if err != nil {
 		log.Fatalf("Failed to create SQLite service: %v", err)
 	}
 
+	ctx := context.Background()
+	for _, key := range strings.Split(*indexKeys, ",") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		if err := sqliteService.IndexKey(ctx, key); err != nil {
+			log.Fatalf("Failed to index %q: %v", key, err)
+		}
+	}
+
+	if *rebuildIndexes {
+		if err := sqliteService.RebuildIndexes(ctx); err != nil {
+			log.Fatalf("Failed to rebuild indexes: %v", err)
+		}
+		log.Printf("Indexes rebuilt")
+		return
+	}
+
 	apiHandler := api.NewAPI(sqliteService)
 
 	apiHandler.CreateRoutes(router)
@@ -40,6 +66,8 @@ func main() {
 		Addr:         address,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
+		// Lets snapshots stream for longer than WriteTimeout.
+		ConnContext: api.ConnContext,
 	}
 
 	log.Printf("Server is running on %s", address)
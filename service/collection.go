@@ -0,0 +1,160 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+// DefaultCollection holds the records served by /api/v1 and those created
+// before collections existed.
+const DefaultCollection = "records"
+
+var ErrCollectionNameInvalid = errors.New("collection name must start with a lower case letter and contain only lower case letters, digits, _ and -")
+
+var collectionName = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,63}$`)
+
+func validateCollection(name string) error {
+	if !collectionName.MatchString(name) {
+		return ErrCollectionNameInvalid
+	}
+	return nil
+}
+
+func (s *SQLiteRecordService) Collection(name string) (RecordService, error) {
+	if err := validateCollection(name); err != nil {
+		return nil, err
+	}
+	return &SQLiteRecordService{db: s.db, collection: name}, nil
+}
+
+func (s *SQLiteRecordService) CreateCollection(ctx context.Context, name string) error {
+	if err := validateCollection(name); err != nil {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx, "INSERT OR IGNORE INTO collections (name) VALUES (?)", name)
+	if err != nil {
+		return fmt.Errorf("failed to create collection: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteRecordService) ListCollections(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT name FROM collections ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %w", err)
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan collection: %w", err)
+		}
+		names = append(names, name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over collections: %w", err)
+	}
+
+	return names, nil
+}
+
+func (s *SQLiteRecordService) SetSchema(ctx context.Context, raw []byte) (entity.Schema, error) {
+	if _, err := parseSchema(raw); err != nil {
+		return entity.Schema{}, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return entity.Schema{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	schema := entity.Schema{Collection: s.collection, Schema: raw, CreatedAt: time.Now().UTC()}
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) + 1 FROM collection_schemas WHERE collection = ?", s.collection).Scan(&schema.Version)
+	if err != nil {
+		return entity.Schema{}, fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO collections (name) VALUES (?)", s.collection); err != nil {
+		return entity.Schema{}, fmt.Errorf("failed to create collection: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO collection_schemas (collection, version, schema, created_at)
+        VALUES (?, ?, ?, ?)
+    `, schema.Collection, schema.Version, string(raw), schema.CreatedAt)
+	if err != nil {
+		return entity.Schema{}, fmt.Errorf("failed to write schema: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return entity.Schema{}, fmt.Errorf("failed to commit schema: %w", err)
+	}
+
+	return schema, nil
+}
+
+func (s *SQLiteRecordService) GetSchema(ctx context.Context, version int) (entity.Schema, error) {
+	if version == 0 {
+		schema, err := latestSchema(ctx, s.db, s.collection)
+		if err != nil {
+			return entity.Schema{}, err
+		}
+		if schema == nil {
+			return entity.Schema{}, ErrSchemaNotFound
+		}
+		return *schema, nil
+	}
+
+	return scanSchema(s.db.QueryRowContext(ctx, `
+        SELECT collection, version, schema, created_at
+        FROM collection_schemas
+        WHERE collection = ? AND version = ?
+    `, s.collection, version))
+}
+
+// latestSchema returns the latest schema of a collection, or nil if it has
+// none.
+func latestSchema(ctx context.Context, q querier, collection string) (*entity.Schema, error) {
+	schema, err := scanSchema(q.QueryRowContext(ctx, `
+        SELECT collection, version, schema, created_at
+        FROM collection_schemas
+        WHERE collection = ?
+        ORDER BY version DESC
+        LIMIT 1
+    `, collection))
+
+	if errors.Is(err, ErrSchemaNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &schema, nil
+}
+
+func scanSchema(row rowScanner) (entity.Schema, error) {
+	var schema entity.Schema
+	var raw string
+
+	err := row.Scan(&schema.Collection, &schema.Version, &raw, &schema.CreatedAt)
+	if err == sql.ErrNoRows {
+		return entity.Schema{}, ErrSchemaNotFound
+	} else if err != nil {
+		return entity.Schema{}, fmt.Errorf("failed to get schema: %w", err)
+	}
+
+	schema.Schema = json.RawMessage(raw)
+	return schema, nil
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+// Filter operators.
+const (
+	OpEq       = "eq"
+	OpNe       = "ne"
+	OpGt       = "gt"
+	OpGte      = "gte"
+	OpLt       = "lt"
+	OpLte      = "lte"
+	OpContains = "contains"
+	OpExists   = "exists"
+)
+
+// Filter is a condition on a single key of a record's data. Values that both
+// parse as numbers are compared numerically, anything else as strings. A
+// record that lacks the key never matches, except for ne.
+type Filter struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+// ParseFilter parses a filter written as key:op:value, e.g. state:eq:CA. The
+// value may itself contain colons; for exists it may be omitted.
+func ParseFilter(s string) (Filter, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) == 2 && parts[1] == OpExists {
+		parts = append(parts, "")
+	}
+	if len(parts) != 3 || parts[0] == "" {
+		return Filter{}, fmt.Errorf("invalid filter %q; must be key:op:value", s)
+	}
+
+	filter := Filter{Key: parts[0], Op: parts[1], Value: parts[2]}
+	switch filter.Op {
+	case OpEq, OpNe, OpGt, OpGte, OpLt, OpLte, OpContains, OpExists:
+	default:
+		return Filter{}, fmt.Errorf("invalid filter %q; unknown operator %q", s, filter.Op)
+	}
+	return filter, nil
+}
+
+// Match reports whether data satisfies the filter.
+func (f Filter) Match(data map[string]interface{}) bool {
+	raw, ok := data[f.Key]
+	if !ok {
+		return f.Op == OpNe
+	}
+	value := entity.ValueString(raw)
+
+	switch f.Op {
+	case OpExists:
+		return true
+	case OpContains:
+		return strings.Contains(value, f.Value)
+	}
+
+	c := compareValues(value, f.Value)
+	switch f.Op {
+	case OpEq:
+		return c == 0
+	case OpNe:
+		return c != 0
+	case OpGt:
+		return c > 0
+	case OpGte:
+		return c >= 0
+	case OpLt:
+		return c < 0
+	case OpLte:
+		return c <= 0
+	}
+	return false
+}
+
+func compareValues(a, b string) int {
+	x, okA := parseNumber(a)
+	y, okB := parseNumber(b)
+	if !okA || !okB {
+		return strings.Compare(a, b)
+	}
+
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// parseNumber parses a finite number.
+func parseNumber(s string) (float64, bool) {
+	x, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(x) || math.IsInf(x, 0) {
+		return 0, false
+	}
+	return x, true
+}
+
+// matchAll reports whether data satisfies every filter.
+func matchAll(filters []Filter, data map[string]interface{}) bool {
+	for _, filter := range filters {
+		if !filter.Match(data) {
+			return false
+		}
+	}
+	return true
+}
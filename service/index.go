@@ -0,0 +1,244 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+var ErrInvalidIndexKey = errors.New("index key must not be empty")
+
+// Indexer is implemented by record services that maintain secondary indexes
+// on selected keys of record data. ListRecords uses them to evaluate filters
+// without scanning every record.
+type Indexer interface {
+	IndexedKeys(ctx context.Context) ([]string, error)
+	// IndexKey starts indexing key, indexing every existing version. It does
+	// nothing if key is already indexed.
+	IndexKey(ctx context.Context, key string) error
+	DropIndex(ctx context.Context, key string) error
+	// RebuildIndexes rebuilds every index from the records.
+	RebuildIndexes(ctx context.Context) error
+}
+
+var _ Indexer = (*SQLiteRecordService)(nil)
+
+func (s *SQLiteRecordService) IndexedKeys(ctx context.Context) ([]string, error) {
+	keys, err := indexedKeys(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]string, 0, len(keys))
+	for key := range keys {
+		list = append(list, key)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+func (s *SQLiteRecordService) IndexKey(ctx context.Context, key string) error {
+	if key == "" {
+		return ErrInvalidIndexKey
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO indexed_keys (key) VALUES (?)", key)
+	if err != nil {
+		return fmt.Errorf("failed to add index: %w", err)
+	}
+	if added, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to add index: %w", err)
+	} else if added == 0 {
+		return nil
+	}
+
+	if err := backfillIndex(ctx, tx, key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteRecordService) DropIndex(ctx context.Context, key string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM indexed_keys WHERE key = ?", key); err != nil {
+		return fmt.Errorf("failed to drop index: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM record_index WHERE key = ?", key); err != nil {
+		return fmt.Errorf("failed to drop index: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteRecordService) RebuildIndexes(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM record_index"); err != nil {
+		return fmt.Errorf("failed to clear indexes: %w", err)
+	}
+	if err := backfillIndex(ctx, tx, ""); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// backfillIndex indexes every stored version under key, or under every
+// indexed key if key is empty.
+func backfillIndex(ctx context.Context, q querier, key string) error {
+	keys := map[string]bool{key: true}
+	if key == "" {
+		var err error
+		if keys, err = indexedKeys(ctx, q); err != nil {
+			return err
+		}
+	}
+
+	records, err := allVersions(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if err := insertIndexEntries(ctx, q, record, keys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// allVersions reads every stored version. Backfills read everything before
+// writing rather than writing while iterating over the rows.
+func allVersions(ctx context.Context, q querier) ([]entity.Record, error) {
+	rows, err := q.QueryContext(ctx, "SELECT "+recordColumns+" FROM records ORDER BY id, version")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read records: %w", err)
+	}
+	defer rows.Close()
+
+	var records []entity.Record
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan record: %w", err)
+		}
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over records: %w", err)
+	}
+
+	return records, nil
+}
+
+// indexVersion adds a newly written version to the indexes.
+func indexVersion(ctx context.Context, q querier, record entity.Record) error {
+	keys, err := indexedKeys(ctx, q)
+	if err != nil {
+		return err
+	}
+	return insertIndexEntries(ctx, q, record, keys)
+}
+
+func insertIndexEntries(ctx context.Context, q querier, record entity.Record, keys map[string]bool) error {
+	for key, raw := range record.Data {
+		if !keys[key] {
+			continue
+		}
+		value := entity.ValueString(raw)
+
+		var num interface{}
+		if x, ok := parseNumber(value); ok {
+			num = x
+		}
+
+		_, err := q.ExecContext(ctx, `
+            INSERT OR IGNORE INTO record_index (collection, key, value, num, id, version)
+            VALUES (?, ?, ?, ?, ?, ?)
+        `, record.Collection, key, value, num, record.ID, record.Version)
+		if err != nil {
+			return fmt.Errorf("failed to index %q: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+func indexedKeys(ctx context.Context, q querier) (map[string]bool, error) {
+	rows, err := q.QueryContext(ctx, "SELECT key FROM indexed_keys")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get indexed keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := map[string]bool{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan indexed key: %w", err)
+		}
+		keys[key] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over indexed keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// indexCondition translates a filter on an indexed key into a condition on
+// record_index that every matching version satisfies. It reports false if
+// the filter cannot use the index.
+func indexCondition(filter Filter, indexed map[string]bool) (string, []interface{}, bool) {
+	if !indexed[filter.Key] {
+		return "", nil, false
+	}
+
+	var op string
+	switch filter.Op {
+	case OpExists:
+		return "key = ?", []interface{}{filter.Key}, true
+	case OpEq:
+		op = "="
+	case OpGt:
+		op = ">"
+	case OpGte:
+		op = ">="
+	case OpLt:
+		op = "<"
+	case OpLte:
+		op = "<="
+	default:
+		return "", nil, false
+	}
+
+	// Mirror compareValues: numbers compare numerically only against other
+	// numbers, everything else compares as strings.
+	if x, ok := parseNumber(filter.Value); ok {
+		condition := "key = ? AND ((num IS NOT NULL AND num " + op + " ?) OR (num IS NULL AND value " + op + " ?))"
+		return condition, []interface{}{filter.Key, x, filter.Value}, true
+	}
+	return "key = ? AND value " + op + " ?", []interface{}{filter.Key, filter.Value}, true
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("sort must be id or updated_at")
+)
+
+const (
+	SortByID        = "id"
+	SortByUpdatedAt = "updated_at"
+
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+// ListOptions selects a page of records for ListRecords. One version of each
+// record is considered, by default its latest; records whose version is a
+// tombstone are skipped.
+type ListOptions struct {
+	// SortBy is SortByID (the default) or SortByUpdatedAt, which orders by
+	// the recording time of the latest version.
+	SortBy     string
+	Descending bool
+	// Cursor continues a previous listing with the same options. It must be
+	// a RecordPage.NextCursor or empty.
+	Cursor string
+	// Limit is the page size, DefaultListLimit if zero, capped at MaxListLimit.
+	Limit int
+	// UpdatedSince, if non-zero, skips records last updated before it.
+	UpdatedSince time.Time
+	// Filters must all match the data of a record's version.
+	Filters []Filter
+	// AsOf, if non-zero, considers the version of each record that was
+	// current at that time instead of the latest one.
+	AsOf time.Time
+	// EffectiveAt, if non-zero, considers the version of each record in
+	// force at that time, as known at AsOf (or now).
+	EffectiveAt time.Time
+}
+
+// RecordPage is a page of records. NextCursor is empty on the last page.
+type RecordPage struct {
+	Records    []entity.Record `json:"records"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// listCursor is the position after the last record of a page.
+type listCursor struct {
+	ID        int       `json:"id"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (o *ListOptions) normalize() (*listCursor, error) {
+	switch o.SortBy {
+	case "":
+		o.SortBy = SortByID
+	case SortByID, SortByUpdatedAt:
+	default:
+		return nil, ErrInvalidSort
+	}
+
+	if o.Limit <= 0 {
+		o.Limit = DefaultListLimit
+	} else if o.Limit > MaxListLimit {
+		o.Limit = MaxListLimit
+	}
+
+	if o.Cursor == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+func encodeCursor(record entity.Record) string {
+	raw, _ := json.Marshal(listCursor{ID: record.ID, UpdatedAt: record.RecordedAt.UTC()})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// less reports whether a sorts before b under the options.
+func (o *ListOptions) less(a, b entity.Record) bool {
+	if o.Descending {
+		a, b = b, a
+	}
+	if o.SortBy == SortByUpdatedAt && !a.RecordedAt.Equal(b.RecordedAt) {
+		return a.RecordedAt.Before(b.RecordedAt)
+	}
+	return a.ID < b.ID
+}
+
+// after reports whether record sorts after the cursor.
+func (o *ListOptions) after(cursor *listCursor, record entity.Record) bool {
+	if cursor == nil {
+		return true
+	}
+	return o.less(entity.Record{ID: cursor.ID, RecordedAt: cursor.UpdatedAt}, record)
+}
+
+// selectVersion picks the version of a record the options consider from its
+// history, ordered by version. It reports false if there is none.
+func (o *ListOptions) selectVersion(history []entity.Record) (entity.Record, bool) {
+	for i := len(history) - 1; i >= 0; i-- {
+		if !o.AsOf.IsZero() && history[i].RecordedAt.After(o.AsOf) {
+			continue
+		}
+		if !o.EffectiveAt.IsZero() && !history[i].EffectiveAt(o.EffectiveAt) {
+			continue
+		}
+		return history[i], true
+	}
+	return entity.Record{}, false
+}
+
+// paginate sorts the selected versions of records and cuts out the page the
+// options select. It is used by implementations that cannot sort natively.
+func paginate(records []entity.Record, opts ListOptions) (RecordPage, error) {
+	cursor, err := opts.normalize()
+	if err != nil {
+		return RecordPage{}, err
+	}
+
+	sort.Slice(records, func(i, j int) bool { return opts.less(records[i], records[j]) })
+
+	page := RecordPage{Records: []entity.Record{}}
+	for _, record := range records {
+		if record.Deleted || !opts.after(cursor, record) {
+			continue
+		}
+		if !opts.UpdatedSince.IsZero() && record.RecordedAt.Before(opts.UpdatedSince) {
+			continue
+		}
+		if !matchAll(opts.Filters, record.Data) {
+			continue
+		}
+		if len(page.Records) == opts.Limit {
+			page.NextCursor = encodeCursor(page.Records[len(page.Records)-1])
+			break
+		}
+		page.Records = append(page.Records, record)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,371 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+// InMemoryRecordService is a RecordService that keeps every version in
+// memory. It behaves like SQLiteRecordService and is safe for concurrent use,
+// which makes it suitable for tests and for embedding.
+type InMemoryRecordService struct {
+	// mu, collections and schemas are shared by the services of every
+	// collection.
+	mu *sync.RWMutex
+	// collections maps a collection name to its records, which map a record
+	// id to its versions, oldest first.
+	collections map[string]map[int][]entity.Record
+	// schemas maps a collection name to its schemas, oldest first.
+	schemas    map[string][]entity.Schema
+	collection string
+}
+
+var _ RecordService = (*InMemoryRecordService)(nil)
+
+func NewInMemoryRecordService() *InMemoryRecordService {
+	return &InMemoryRecordService{
+		mu:          &sync.RWMutex{},
+		collections: map[string]map[int][]entity.Record{DefaultCollection: {}},
+		schemas:     map[string][]entity.Schema{},
+		collection:  DefaultCollection,
+	}
+}
+
+// records returns the records of the service's collection. The caller must
+// hold mu.
+func (s *InMemoryRecordService) records() map[int][]entity.Record {
+	return s.collections[s.collection]
+}
+
+func (s *InMemoryRecordService) Collection(name string) (RecordService, error) {
+	if err := validateCollection(name); err != nil {
+		return nil, err
+	}
+	return &InMemoryRecordService{mu: s.mu, collections: s.collections, schemas: s.schemas, collection: name}, nil
+}
+
+func (s *InMemoryRecordService) CreateCollection(ctx context.Context, name string) error {
+	if err := validateCollection(name); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.collections[name] == nil {
+		s.collections[name] = map[int][]entity.Record{}
+	}
+	return nil
+}
+
+func (s *InMemoryRecordService) ListCollections(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.collections))
+	for name := range s.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *InMemoryRecordService) GetRecord(ctx context.Context, id int) (entity.Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.records()[id]
+	if len(versions) == 0 {
+		return entity.Record{}, ErrRecordDoesNotExist
+	}
+
+	latest := versions[len(versions)-1]
+	if latest.Deleted {
+		return entity.Record{}, ErrRecordDeleted
+	}
+
+	return latest.Copy(), nil
+}
+
+func (s *InMemoryRecordService) GetRecordVersion(ctx context.Context, id, version int) (entity.Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.records()[id]
+	if version <= 0 || version > len(versions) {
+		return entity.Record{}, ErrVersionNotFound
+	}
+
+	return versions[version-1].Copy(), nil
+}
+
+func (s *InMemoryRecordService) GetRecordAsOf(ctx context.Context, id int, t time.Time) (entity.Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.records()[id]
+	if len(versions) == 0 {
+		return entity.Record{}, ErrRecordDoesNotExist
+	}
+
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].RecordedAt.After(t) {
+			continue
+		}
+		if versions[i].Deleted {
+			return entity.Record{}, ErrRecordDeleted
+		}
+		return versions[i].Copy(), nil
+	}
+
+	return entity.Record{}, ErrRecordNotYetCreated
+}
+
+func (s *InMemoryRecordService) GetRecordBitemporal(ctx context.Context, id int, effectiveAt, recordedAt time.Time) (entity.Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.records()[id]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].RecordedAt.After(recordedAt) || !versions[i].EffectiveAt(effectiveAt) {
+			continue
+		}
+		if versions[i].Deleted {
+			return entity.Record{}, ErrRecordDeleted
+		}
+		return versions[i].Copy(), nil
+	}
+
+	return entity.Record{}, ErrVersionNotFound
+}
+
+func (s *InMemoryRecordService) CreateRecord(ctx context.Context, record entity.Record) error {
+	opts := WriteOptions{
+		EffectiveFrom: record.EffectiveFrom,
+		EffectiveTo:   record.EffectiveTo,
+		Author:        record.Author,
+		Reason:        record.Reason,
+	}
+	_, err := s.appendVersion(record.ID, opts, true, createMutation(record.Data))
+	return err
+}
+
+func (s *InMemoryRecordService) UpdateRecord(ctx context.Context, id int, updates map[string]interface{}) (entity.Record, error) {
+	return s.UpdateRecordWithVersion(ctx, id, updates, WriteOptions{})
+}
+
+func (s *InMemoryRecordService) UpdateRecordWithVersion(ctx context.Context, id int, updates map[string]interface{}, opts WriteOptions) (entity.Record, error) {
+	return s.appendVersion(id, opts, false, updateMutation(updates))
+}
+
+func (s *InMemoryRecordService) UpsertRecord(ctx context.Context, id int, updates map[string]interface{}, opts WriteOptions) (entity.Record, error) {
+	return s.appendVersion(id, opts, true, upsertMutation(updates))
+}
+
+func (s *InMemoryRecordService) PatchRecord(ctx context.Context, id int, patch Patch, opts WriteOptions) (entity.Record, error) {
+	opts.singleVersion = true
+	return s.appendVersion(id, opts, true, patchMutation(patch))
+}
+
+func (s *InMemoryRecordService) DeleteRecord(ctx context.Context, id int, opts WriteOptions) (entity.Record, error) {
+	return s.appendVersion(id, opts, false, deleteMutation)
+}
+
+func (s *InMemoryRecordService) RestoreRecord(ctx context.Context, id int, opts WriteOptions) (entity.Record, error) {
+	return s.appendVersion(id, opts, false, restoreMutation)
+}
+
+func (s *InMemoryRecordService) RevertRecord(ctx context.Context, id, version int, opts WriteOptions) (entity.Record, error) {
+	target, err := s.GetRecordVersion(ctx, id, version)
+	if err != nil {
+		return entity.Record{}, err
+	}
+
+	return s.appendVersion(id, opts, false, revertMutation(target))
+}
+
+func (s *InMemoryRecordService) GetRecordVersions(ctx context.Context, id int) ([]entity.VersionInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.records()[id]
+	if len(versions) == 0 {
+		return nil, ErrRecordDoesNotExist
+	}
+
+	return describeVersions(versions)
+}
+
+func (s *InMemoryRecordService) GetRecordHistory(ctx context.Context, id int) ([]entity.Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.records()[id]
+	if len(versions) == 0 {
+		return nil, ErrRecordDoesNotExist
+	}
+
+	history := make([]entity.Record, len(versions))
+	for i := range versions {
+		history[i] = versions[i].Copy()
+	}
+	return history, nil
+}
+
+func (s *InMemoryRecordService) ListRecords(ctx context.Context, opts ListOptions) (RecordPage, error) {
+	s.mu.RLock()
+	selected := make([]entity.Record, 0, len(s.records()))
+	for _, versions := range s.records() {
+		if record, ok := opts.selectVersion(versions); ok {
+			selected = append(selected, record.Copy())
+		}
+	}
+	s.mu.RUnlock()
+
+	return paginate(selected, opts)
+}
+
+func (s *InMemoryRecordService) SearchRecords(ctx context.Context, opts SearchOptions) ([]entity.Record, error) {
+	terms, err := parseSearchQuery(opts.Query)
+	if err != nil {
+		return nil, err
+	}
+	opts.normalize()
+
+	s.mu.RLock()
+	var matches []entity.Record
+	for _, versions := range s.records() {
+		candidates := versions
+		if !opts.AllVersions {
+			candidates = versions[len(versions)-1:]
+		}
+		for _, record := range candidates {
+			if !record.Deleted && matchSearch(record, terms) {
+				matches = append(matches, record.Copy())
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].ID != matches[j].ID {
+			return matches[i].ID < matches[j].ID
+		}
+		return matches[i].Version < matches[j].Version
+	})
+
+	if len(matches) > opts.Limit {
+		matches = matches[:opts.Limit]
+	}
+	if matches == nil {
+		matches = []entity.Record{}
+	}
+	return matches, nil
+}
+
+func (s *InMemoryRecordService) Snapshot(ctx context.Context, t time.Time, fn func(entity.Record) error) error {
+	// The versions are copied under the lock so that fn can take its time.
+	s.mu.RLock()
+	var snapshot []entity.Record
+	for _, records := range s.collections {
+		for _, versions := range records {
+			for i := len(versions) - 1; i >= 0; i-- {
+				if versions[i].RecordedAt.After(t) {
+					continue
+				}
+				if !versions[i].Deleted {
+					snapshot = append(snapshot, versions[i].Copy())
+				}
+				break
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		if snapshot[i].Collection != snapshot[j].Collection {
+			return snapshot[i].Collection < snapshot[j].Collection
+		}
+		return snapshot[i].ID < snapshot[j].ID
+	})
+
+	for _, record := range snapshot {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryRecordService) SetSchema(ctx context.Context, raw []byte) (entity.Schema, error) {
+	if _, err := parseSchema(raw); err != nil {
+		return entity.Schema{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.collections[s.collection] == nil {
+		s.collections[s.collection] = map[int][]entity.Record{}
+	}
+
+	schema := entity.Schema{
+		Collection: s.collection,
+		Version:    len(s.schemas[s.collection]) + 1,
+		Schema:     append([]byte(nil), raw...),
+		CreatedAt:  time.Now().UTC(),
+	}
+	s.schemas[s.collection] = append(s.schemas[s.collection], schema)
+	return schema, nil
+}
+
+func (s *InMemoryRecordService) GetSchema(ctx context.Context, version int) (entity.Schema, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	schemas := s.schemas[s.collection]
+	if version == 0 {
+		version = len(schemas)
+	}
+	if version <= 0 || version > len(schemas) {
+		return entity.Schema{}, ErrSchemaNotFound
+	}
+	return schemas[version-1], nil
+}
+
+// appendVersion mirrors SQLiteRecordService.appendVersion, with the write
+// lock standing in for the transaction.
+func (s *InMemoryRecordService) appendVersion(id int, opts WriteOptions, create bool, mutate func(record *entity.Record) error) (entity.Record, error) {
+	if id <= 0 {
+		return entity.Record{}, ErrRecordIDInvalid
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var schema *entity.Schema
+	if schemas := s.schemas[s.collection]; len(schemas) > 0 {
+		schema = &schemas[len(schemas)-1]
+	}
+
+	history := s.records()[id]
+	versions, err := nextVersions(history, s.collection, id, time.Now().UTC(), opts, create, schema, mutate)
+	if err != nil {
+		return entity.Record{}, err
+	}
+
+	records := s.collections[s.collection]
+	if records == nil {
+		records = map[int][]entity.Record{}
+		s.collections[s.collection] = records
+	}
+	for _, record := range versions {
+		history = append(history, record.Copy())
+	}
+	records[id] = history
+	return versions[len(versions)-1], nil
+}
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration upgrades the database inside the transaction it is given.
+type migration func(tx *sql.Tx) error
+
+// execMigration is a migration made of SQL statements.
+func execMigration(statements string) migration {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// migrations upgrade the schema created by createTable. They are applied in
+// order and tracked with SQLite's user_version pragma, so migration i brings
+// the database to user_version i+1. Only ever append to this list.
+var migrations = []migration{
+	// 1: bitemporal columns. Existing versions are assumed to have been
+	// effective from the moment they were written.
+	execMigration(`
+        ALTER TABLE records ADD COLUMN recorded_at TIMESTAMP;
+        ALTER TABLE records ADD COLUMN effective_from TIMESTAMP;
+        ALTER TABLE records ADD COLUMN effective_to TIMESTAMP;
+        UPDATE records SET recorded_at = updated_at, effective_from = updated_at;
+    `),
+	// 2: tombstones for soft deletes.
+	execMigration(`
+        ALTER TABLE records ADD COLUMN deleted BOOLEAN NOT NULL DEFAULT 0;
+    `),
+	// 3: who made each version and why.
+	execMigration(`
+        ALTER TABLE records ADD COLUMN author TEXT NOT NULL DEFAULT '';
+        ALTER TABLE records ADD COLUMN reason TEXT NOT NULL DEFAULT '';
+    `),
+	// 4: secondary indexes on selected keys of record data. num holds the
+	// value if it is a number, so that ranges can use the index too.
+	execMigration(`
+        CREATE TABLE indexed_keys (
+            key TEXT PRIMARY KEY
+        );
+        CREATE TABLE record_index (
+            key TEXT NOT NULL,
+            value TEXT NOT NULL,
+            num REAL,
+            id INTEGER NOT NULL,
+            version INTEGER NOT NULL,
+            PRIMARY KEY (key, value, id, version)
+        );
+        CREATE INDEX record_index_num ON record_index (key, num);
+    `),
+	// 5: collections with their own id spaces. Existing records form the
+	// records collection. SQLite cannot change a primary key, so the tables
+	// keyed by record id are rebuilt; the search index is recreated on open.
+	execMigration(`
+        CREATE TABLE collections (
+            name TEXT PRIMARY KEY,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+        INSERT INTO collections (name) VALUES ('records');
+
+        CREATE TABLE records_new (
+            collection TEXT NOT NULL,
+            id INTEGER,
+            version INTEGER,
+            data TEXT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            recorded_at TIMESTAMP,
+            effective_from TIMESTAMP,
+            effective_to TIMESTAMP,
+            deleted BOOLEAN NOT NULL DEFAULT 0,
+            author TEXT NOT NULL DEFAULT '',
+            reason TEXT NOT NULL DEFAULT '',
+            PRIMARY KEY (collection, id, version)
+        );
+        INSERT INTO records_new (
+            collection, id, version, data, created_at, updated_at, recorded_at, effective_from,
+            effective_to, deleted, author, reason
+        )
+        SELECT
+            'records', id, version, data, created_at, updated_at, recorded_at, effective_from,
+            effective_to, deleted, author, reason
+        FROM records;
+        DROP TABLE records;
+        ALTER TABLE records_new RENAME TO records;
+
+        CREATE TABLE record_index_new (
+            collection TEXT NOT NULL,
+            key TEXT NOT NULL,
+            value TEXT NOT NULL,
+            num REAL,
+            id INTEGER NOT NULL,
+            version INTEGER NOT NULL,
+            PRIMARY KEY (key, value, collection, id, version)
+        );
+        INSERT INTO record_index_new (collection, key, value, num, id, version)
+        SELECT 'records', key, value, num, id, version FROM record_index;
+        DROP TABLE record_index;
+        ALTER TABLE record_index_new RENAME TO record_index;
+        CREATE INDEX record_index_num ON record_index (key, num);
+
+        DROP TABLE IF EXISTS record_search;
+    `),
+	// 6: versioned JSON Schemas per collection, and the schema version each
+	// record version was validated with (0 if none).
+	execMigration(`
+        CREATE TABLE collection_schemas (
+            collection TEXT NOT NULL,
+            version INTEGER NOT NULL,
+            schema TEXT NOT NULL,
+            created_at TIMESTAMP NOT NULL,
+            PRIMARY KEY (collection, version)
+        );
+        ALTER TABLE records ADD COLUMN schema_version INTEGER NOT NULL DEFAULT 0;
+    `),
+	// 7: timestamps in UTC. The first releases wrote local time, which
+	// migration 1 copied into recorded_at and effective_from, and which does
+	// not compare as text with the UTC times written since.
+	normalizeTimestamps,
+}
+
+// normalizeTimestamps rewrites every timestamp of every version in UTC,
+// letting the driver format them as it does for new versions.
+func normalizeTimestamps(tx *sql.Tx) error {
+	type version struct {
+		collection string
+		id, number int
+		times      [5]sql.NullTime
+	}
+
+	rows, err := tx.Query("SELECT collection, id, version, created_at, updated_at, recorded_at, effective_from, effective_to FROM records")
+	if err != nil {
+		return err
+	}
+	var versions []version
+	for rows.Next() {
+		var v version
+		if err := rows.Scan(&v.collection, &v.id, &v.number, &v.times[0], &v.times[1], &v.times[2], &v.times[3], &v.times[4]); err != nil {
+			rows.Close()
+			return err
+		}
+		versions = append(versions, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		args := make([]interface{}, 0, 8)
+		for _, t := range v.times {
+			if t.Valid {
+				args = append(args, t.Time.UTC())
+			} else {
+				args = append(args, nil)
+			}
+		}
+		args = append(args, v.collection, v.id, v.number)
+
+		_, err := tx.Exec(`
+            UPDATE records
+            SET created_at = ?, updated_at = ?, recorded_at = ?, effective_from = ?, effective_to = ?
+            WHERE collection = ? AND id = ? AND version = ?
+        `, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrate(db *sql.DB) error {
+	var current int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", i+1, err)
+		}
+
+		if err := migrations[i](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+
+		// PRAGMA does not accept bound parameters.
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", i+1, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package service_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rainbowmga/timetravel/service"
+)
+
+// TestMigrateBaseline opens a database written by the first release, which
+// stored local times, and checks that time travel treats them as instants.
+func TestMigrateBaseline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = db.Exec(`
+        CREATE TABLE records (
+            id INTEGER,
+            version INTEGER,
+            data TEXT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (id, version)
+        );
+        INSERT INTO records (id, version, data, created_at, updated_at) VALUES
+            (1, 1, '{"name":"Acme"}', '2024-01-02 15:47:44.123456789-08:00', '2024-01-02 15:47:44.123456789-08:00'),
+            (1, 2, '{"name":"Acme Inc"}', '2024-01-02 15:47:44.123456789-08:00', '2024-01-03 09:00:00-08:00');
+    `)
+	db.Close()
+	if err != nil {
+		t.Fatalf("Failed to seed database: %v", err)
+	}
+
+	s, err := service.NewSQLiteRecordService(path)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	created := time.Date(2024, 1, 2, 23, 47, 44, 123456789, time.UTC)
+
+	if _, err := s.GetRecordAsOf(ctx, 1, time.Date(2024, 1, 2, 20, 0, 0, 0, time.UTC)); !errors.Is(err, service.ErrRecordNotYetCreated) {
+		t.Errorf("GetRecordAsOf before creation: got %v, want ErrRecordNotYetCreated", err)
+	}
+
+	for _, c := range []struct {
+		at      time.Time
+		version int
+	}{
+		{created, 1},
+		{time.Date(2024, 1, 3, 16, 59, 0, 0, time.UTC), 1},
+		{time.Date(2024, 1, 3, 17, 0, 0, 0, time.UTC), 2},
+	} {
+		record, err := s.GetRecordAsOf(ctx, 1, c.at)
+		if err != nil {
+			t.Fatalf("GetRecordAsOf(%v): %v", c.at, err)
+		}
+		if record.Version != c.version {
+			t.Errorf("GetRecordAsOf(%v): got version %d, want %d", c.at, record.Version, c.version)
+		}
+	}
+
+	record, err := s.GetRecordVersion(ctx, 1, 1)
+	if err != nil {
+		t.Fatalf("GetRecordVersion: %v", err)
+	}
+	if !record.RecordedAt.Equal(created) || record.RecordedAt.Location() != time.UTC || !record.EffectiveFrom.Equal(created) {
+		t.Errorf("migrated version: got recorded_at %v and effective_from %v, want %v", record.RecordedAt, record.EffectiveFrom, created)
+	}
+
+	// Versions written since compare with the migrated ones.
+	if _, err := s.UpsertRecord(ctx, 1, map[string]interface{}{"name": "Acme Corp"}, service.WriteOptions{}); err != nil {
+		t.Fatalf("UpsertRecord: %v", err)
+	}
+	page, err := s.ListRecords(ctx, service.ListOptions{AsOf: time.Date(2024, 1, 3, 17, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatalf("ListRecords: %v", err)
+	}
+	if len(page.Records) != 1 || page.Records[0].Version != 2 {
+		t.Errorf("ListRecords as of the second version: got %+v, want version 2", page.Records)
+	}
+}
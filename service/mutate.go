@@ -0,0 +1,275 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+// The mutations below turn the latest version of a record into the next one.
+// They are shared by every RecordService implementation through their
+// appendVersion methods; a new record arrives at version 0.
+
+func createMutation(data map[string]interface{}) func(record *entity.Record) error {
+	return func(record *entity.Record) error {
+		if record.Version != 0 && !record.Deleted {
+			return ErrRecordAlreadyExists
+		}
+		normalized, err := entity.NormalizeData(data)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+		record.Data = normalized
+		record.Deleted = false
+		return nil
+	}
+}
+
+func updateMutation(updates map[string]interface{}) func(record *entity.Record) error {
+	return func(record *entity.Record) error {
+		if record.Deleted {
+			return ErrRecordDeleted
+		}
+		return applyUpdates(record.Data, updates)
+	}
+}
+
+// upsertMutation writes over a deleted record as if it were new.
+func upsertMutation(updates map[string]interface{}) func(record *entity.Record) error {
+	return func(record *entity.Record) error {
+		if record.Deleted {
+			record.Data = map[string]interface{}{}
+			record.Deleted = false
+		}
+		return applyUpdates(record.Data, updates)
+	}
+}
+
+// patchMutation applies a patch, writing over a deleted record as if it were
+// new like upsertMutation.
+func patchMutation(patch Patch) func(record *entity.Record) error {
+	return func(record *entity.Record) error {
+		if record.Deleted {
+			record.Data = map[string]interface{}{}
+			record.Deleted = false
+		}
+
+		data, err := patch.Apply(record.Data)
+		if err != nil {
+			return err
+		}
+
+		normalized, err := entity.NormalizeData(data)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+		record.Data = normalized
+		return nil
+	}
+}
+
+// deleteMutation turns the record into a tombstone. The tombstone keeps the
+// data it deleted so that the record can be restored.
+func deleteMutation(record *entity.Record) error {
+	if record.Deleted {
+		return ErrRecordDeleted
+	}
+	record.Deleted = true
+	return nil
+}
+
+func restoreMutation(record *entity.Record) error {
+	if !record.Deleted {
+		return ErrRecordNotDeleted
+	}
+	record.Deleted = false
+	return nil
+}
+
+// revertMutation replaces the record's data with that of an earlier version.
+// Reverting a deleted record revives it.
+func revertMutation(target entity.Record) func(record *entity.Record) error {
+	return func(record *entity.Record) error {
+		if target.Deleted {
+			return ErrRevertToTombstone
+		}
+		record.Data = make(map[string]interface{}, len(target.Data))
+		for key, value := range target.Data {
+			record.Data[key] = entity.CopyValue(value)
+		}
+		record.Deleted = false
+		return nil
+	}
+}
+
+// applyUpdates merges updates into data. A nil value deletes the key.
+func applyUpdates(data map[string]interface{}, updates map[string]interface{}) error {
+	normalized, err := entity.NormalizeData(updates)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidValue, err)
+	}
+
+	for key, value := range normalized {
+		if value == nil {
+			delete(data, key)
+		} else {
+			data[key] = value
+		}
+	}
+	return nil
+}
+
+// segment is a stretch of valid time over which the same version of a record
+// is in force, as known now. base is nil if none is.
+type segment struct {
+	from time.Time
+	to   *time.Time
+	base *entity.Record
+}
+
+// segments splits the valid time [from, to) of a write wherever the version
+// of the record in force changes. A nil to means until further notice.
+func segments(history []entity.Record, from time.Time, to *time.Time) []segment {
+	var bounds []time.Time
+	within := func(t time.Time) bool {
+		return t.After(from) && (to == nil || t.Before(*to))
+	}
+	for _, version := range history {
+		if within(version.EffectiveFrom) {
+			bounds = append(bounds, version.EffectiveFrom)
+		}
+		if version.EffectiveTo != nil && within(*version.EffectiveTo) {
+			bounds = append(bounds, *version.EffectiveTo)
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i].Before(bounds[j]) })
+
+	result := []segment{{from: from, to: to, base: entity.InForce(history, from)}}
+	for _, bound := range bounds {
+		base := entity.InForce(history, bound)
+		last := &result[len(result)-1]
+		if base == last.base {
+			continue
+		}
+		end := bound
+		last.to = &end
+		result = append(result, segment{from: bound, to: to, base: base})
+	}
+	return result
+}
+
+// nextVersions applies mutate to a record's history, oldest first, and returns
+// the versions to append. The write applies to the state in force when it
+// takes effect rather than to the latest version, which may only take effect
+// later. A back-dated write is carried forward over every later change within
+// its valid time, as one version per stretch, until the record is deleted.
+// The latest version always holds the record's final state, the one in force
+// once every change has taken effect: when the write ends before it, or stops
+// at a later delete, a last version restates it. A patch, for which
+// opts.singleVersion is set, must fit in a single version.
+// If the record does not exist and create is set, mutate starts from an empty
+// record at version 0. schema, if not nil, must match every new version.
+func nextVersions(history []entity.Record, collection string, id int, now time.Time, opts WriteOptions, create bool, schema *entity.Schema, mutate func(record *entity.Record) error) ([]entity.Record, error) {
+	effectiveFrom, effectiveTo, err := opts.validity(now)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := entity.Record{Collection: collection, ID: id, Data: map[string]interface{}{}, CreatedAt: now}
+	if len(history) > 0 {
+		latest = history[len(history)-1]
+	} else if !create {
+		return nil, ErrRecordDoesNotExist
+	}
+
+	if err := opts.checkVersion(latest.Version); err != nil {
+		return nil, err
+	}
+	if opts.MustExist && (latest.Version == 0 || latest.Deleted) {
+		return nil, ErrPreconditionFailed
+	}
+
+	stretches := segments(history, effectiveFrom, effectiveTo)
+	if opts.singleVersion && len(stretches) > 1 {
+		return nil, ErrPatchSpansChanges
+	}
+
+	version := latest.Version
+	var next []entity.Record
+	for i, segment := range stretches {
+		record := entity.Record{Collection: collection, ID: id, Data: map[string]interface{}{}, CreatedAt: latest.CreatedAt}
+		if segment.base != nil {
+			record = segment.base.Copy()
+		}
+		if i > 0 && (segment.base == nil || record.Deleted) {
+			continue
+		}
+
+		// Mutations tell whether the record exists from its latest version.
+		record.Version = latest.Version
+		if err := mutate(&record); i > 0 && errors.Is(err, ErrRecordNotDeleted) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		version++
+		record.Version = version
+		record.UpdatedAt = now
+		record.RecordedAt = now
+		record.EffectiveFrom = segment.from
+		record.EffectiveTo = segment.to
+		record.Author = opts.Author
+		record.Reason = opts.Reason
+
+		record.SchemaVersion = 0
+		if !record.Deleted {
+			if err := checkReferences(record.Data); err != nil {
+				return nil, err
+			}
+			if record.SchemaVersion, err = checkData(schema, record.Data); err != nil {
+				return nil, err
+			}
+		}
+
+		next = append(next, record)
+	}
+
+	all := append(append([]entity.Record{}, history...), next...)
+	end := lastChange(all)
+	if final := entity.InForce(all, end); final != nil && final.Version != version {
+		record := final.Copy()
+		version++
+		record.Version = version
+		record.UpdatedAt = now
+		record.RecordedAt = now
+		record.EffectiveFrom = end
+		record.EffectiveTo = nil
+		record.Author = opts.Author
+		record.Reason = opts.Reason
+		next = append(next, record)
+	}
+	if opts.singleVersion && len(next) > 1 {
+		return nil, ErrPatchSpansChanges
+	}
+
+	return next, nil
+}
+
+// lastChange returns the last time in valid time at which the version of the
+// record in force changes.
+func lastChange(history []entity.Record) time.Time {
+	var last time.Time
+	for _, version := range history {
+		if version.EffectiveFrom.After(last) {
+			last = version.EffectiveFrom
+		}
+		if version.EffectiveTo != nil && version.EffectiveTo.After(last) {
+			last = *version.EffectiveTo
+		}
+	}
+	return last
+}
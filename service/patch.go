@@ -0,0 +1,52 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+// ErrPatchSpansChanges is returned for a patch that would append more than
+// one version, because its valid time covers later changes to the record or
+// ends before them.
+var ErrPatchSpansChanges = errors.New("a patch writes exactly one version; its valid time cannot span later changes or end before them")
+
+// Patch computes the data of a record's next version from its current data.
+// Apply must not modify data.
+type Patch interface {
+	Apply(data map[string]interface{}) (map[string]interface{}, error)
+}
+
+// MergePatch is a JSON Merge Patch (RFC 7396). Objects merge recursively and
+// null deletes the key it is set for, at any depth.
+type MergePatch map[string]interface{}
+
+func (p MergePatch) Apply(data map[string]interface{}) (map[string]interface{}, error) {
+	merged := mergePatch(data, map[string]interface{}(p))
+	return merged.(map[string]interface{}), nil
+}
+
+// mergePatch implements the MergePatch algorithm of RFC 7396, copying target
+// rather than modifying it.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return entity.CopyValue(patch)
+	}
+
+	targetObject, _ := target.(map[string]interface{})
+	merged := make(map[string]interface{}, len(targetObject)+len(patchObject))
+	for key, value := range targetObject {
+		merged[key] = value
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = mergePatch(merged[key], value)
+		}
+	}
+
+	return merged
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -17,23 +18,122 @@ var (
 	ErrRecordIDInvalid     = errors.New("record id must be >= 0")
 	ErrRecordAlreadyExists = errors.New("record already exists")
 	ErrVersionNotFound     = errors.New("version not found")
+	ErrInvalidValidity     = errors.New("effective_to must be after effective_from")
+	ErrRecordNotYetCreated = errors.New("record did not exist at that time")
+	ErrVersionConflict     = errors.New("version conflict")
+	// ErrRecordDeleted matches ErrRecordDoesNotExist, so callers that only
+	// care whether a record can be read need not tell the two apart.
+	ErrRecordDeleted      = fmt.Errorf("%w: record has been deleted", ErrRecordDoesNotExist)
+	ErrRecordNotDeleted   = errors.New("record is not deleted")
+	ErrRevertToTombstone  = errors.New("cannot revert to a deleted version; restore the record instead")
+	ErrInvalidValue       = errors.New("record data must be json")
+	ErrPreconditionFailed = errors.New("precondition failed: record does not exist")
 )
 
 type RecordService interface {
 	GetRecord(ctx context.Context, id int) (entity.Record, error)
 	GetRecordVersion(ctx context.Context, id, version int) (entity.Record, error)
+	// GetRecordAsOf returns the version that was current at t.
+	GetRecordAsOf(ctx context.Context, id int, t time.Time) (entity.Record, error)
+	// GetRecordBitemporal answers "what did we believe at recordedAt about the
+	// state of the record effective at effectiveAt".
+	GetRecordBitemporal(ctx context.Context, id int, effectiveAt, recordedAt time.Time) (entity.Record, error)
 	CreateRecord(ctx context.Context, record entity.Record) error
-	UpdateRecord(ctx context.Context, id int, updates map[string]*string) (entity.Record, error)
-	UpdateRecordWithVersion(ctx context.Context, id int, updates map[string]*string) (entity.Record, error)
-	GetRecordVersions(ctx context.Context, id int) ([]int, error)
+	UpdateRecord(ctx context.Context, id int, updates map[string]interface{}) (entity.Record, error)
+	UpdateRecordWithVersion(ctx context.Context, id int, updates map[string]interface{}, opts WriteOptions) (entity.Record, error)
+	// UpsertRecord creates the record from updates or merges updates into its
+	// latest version, atomically.
+	UpsertRecord(ctx context.Context, id int, updates map[string]interface{}, opts WriteOptions) (entity.Record, error)
+	// PatchRecord creates the record by applying patch to empty data, or
+	// applies patch to its latest version, atomically. It appends exactly one
+	// version or fails with ErrPatchSpansChanges.
+	PatchRecord(ctx context.Context, id int, patch Patch, opts WriteOptions) (entity.Record, error)
+	// DeleteRecord appends a tombstone version. History stays readable.
+	DeleteRecord(ctx context.Context, id int, opts WriteOptions) (entity.Record, error)
+	// RestoreRecord revives a deleted record as a new version.
+	RestoreRecord(ctx context.Context, id int, opts WriteOptions) (entity.Record, error)
+	// RevertRecord appends a new version whose data equals that of version.
+	RevertRecord(ctx context.Context, id, version int, opts WriteOptions) (entity.Record, error)
+	GetRecordVersions(ctx context.Context, id int) ([]entity.VersionInfo, error)
+	// GetRecordHistory returns every version of a record, oldest first.
+	GetRecordHistory(ctx context.Context, id int) ([]entity.Record, error)
+	// ListRecords returns a page of records, by default their latest versions.
+	ListRecords(ctx context.Context, opts ListOptions) (RecordPage, error)
+	// Collection returns the service for the named collection, which has its
+	// own ids and versions. The service returned by a constructor serves
+	// DefaultCollection.
+	Collection(name string) (RecordService, error)
+	// CreateCollection registers a collection. A collection is also created
+	// by the first write to it.
+	CreateCollection(ctx context.Context, name string) error
+	ListCollections(ctx context.Context) ([]string, error)
+	// SetSchema registers a new version of the collection's JSON Schema. Every
+	// later version of its records, other than tombstones, must match it.
+	SetSchema(ctx context.Context, schema []byte) (entity.Schema, error)
+	// GetSchema returns a version of the collection's schema, the latest one
+	// if version is 0.
+	GetSchema(ctx context.Context, version int) (entity.Schema, error)
+	// SearchRecords returns the versions whose values contain every word of
+	// the query, ordered by id and version.
+	SearchRecords(ctx context.Context, opts SearchOptions) ([]entity.Record, error)
+	// Snapshot calls fn with the version of every record, in every
+	// collection, that was current at t, ordered by collection and id.
+	// Records created after t or deleted at t are left out. All versions are
+	// read at once, so writes made while fn runs are not seen.
+	Snapshot(ctx context.Context, t time.Time, fn func(entity.Record) error) error
+}
+
+// WriteOptions carries the per-version metadata supplied alongside a write.
+type WriteOptions struct {
+	// EffectiveFrom is the start of the new version's valid time. The zero
+	// value means the version is effective from the moment it is recorded.
+	// A write applies to the state in force at EffectiveFrom; see
+	// nextVersions for writes back-dated past later changes.
+	EffectiveFrom time.Time
+	EffectiveTo   *time.Time
+	// Author and Reason are recorded on the new version for auditing.
+	Author string
+	Reason string
+	// ExpectedVersion, when non-zero, makes the write fail with a
+	// VersionConflictError unless it matches the record's current version.
+	ExpectedVersion int
+	// MustExist makes the write fail with ErrPreconditionFailed if the record
+	// does not exist or is deleted.
+	MustExist bool
+	// singleVersion makes the write fail with ErrPatchSpansChanges unless it
+	// appends exactly one version. PatchRecord sets it.
+	singleVersion bool
+}
+
+// VersionConflictError is returned when a write's expected version does not
+// match the record's current version. It matches ErrVersionConflict.
+type VersionConflictError struct {
+	Expected int
+	Current  int
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("%v: expected version %d, current version is %d", ErrVersionConflict, e.Expected, e.Current)
+}
+
+func (e *VersionConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
 }
 
 type SQLiteRecordService struct {
-	db *sql.DB
+	db         *sql.DB
+	collection string
 }
 
 func NewSQLiteRecordService(dbPath string) (*SQLiteRecordService, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	// Writers take the write lock when their transaction begins and wait for
+	// each other rather than failing with SQLITE_BUSY. In WAL mode readers,
+	// such as a snapshot being streamed, do not hold writers up.
+	separator := "?"
+	if strings.Contains(dbPath, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite3", dbPath+separator+"_txlock=immediate&_busy_timeout=5000&_journal_mode=WAL")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -46,7 +146,20 @@ func NewSQLiteRecordService(dbPath string) (*SQLiteRecordService, error) {
 		return nil, fmt.Errorf("failed to create table: %w", err)
 	}
 
-	return &SQLiteRecordService{db: db}, nil
+	if err := migrate(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	if err := createSearchTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create search index: %w", err)
+	}
+
+	return &SQLiteRecordService{db: db, collection: DefaultCollection}, nil
+}
+
+// Close closes the underlying database, which is shared by every collection.
+func (s *SQLiteRecordService) Close() error {
+	return s.db.Close()
 }
 
 func createTable(db *sql.DB) error {
@@ -63,17 +176,69 @@ func createTable(db *sql.DB) error {
 	return err
 }
 
-func (s *SQLiteRecordService) GetRecord(ctx context.Context, id int) (entity.Record, error) {
+// recordColumns is the column list understood by scanRecord.
+const recordColumns = "collection, id, version, data, created_at, updated_at, recorded_at, effective_from, effective_to, deleted, author, reason, schema_version"
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRecord(row rowScanner) (entity.Record, error) {
 	var record entity.Record
 	var dataJSON string
+	var effectiveTo sql.NullTime
+
+	err := row.Scan(
+		&record.Collection, &record.ID, &record.Version, &dataJSON, &record.CreatedAt, &record.UpdatedAt,
+		&record.RecordedAt, &record.EffectiveFrom, &effectiveTo, &record.Deleted,
+		&record.Author, &record.Reason, &record.SchemaVersion,
+	)
+	if err != nil {
+		return entity.Record{}, err
+	}
+
+	if effectiveTo.Valid {
+		record.EffectiveTo = &effectiveTo.Time
+	}
+
+	if record.Data, err = entity.UnmarshalData([]byte(dataJSON)); err != nil {
+		return entity.Record{}, fmt.Errorf("failed to unmarshal record data: %w", err)
+	}
+	if record.Data == nil {
+		record.Data = map[string]interface{}{}
+	}
+
+	return record, nil
+}
+
+func (s *SQLiteRecordService) GetRecord(ctx context.Context, id int) (entity.Record, error) {
+	record, err := getRecord(ctx, s.db, s.collection, id)
+	if err != nil {
+		return entity.Record{}, err
+	}
+	if record.Deleted {
+		return entity.Record{}, ErrRecordDeleted
+	}
+
+	return record, nil
+}
 
-	err := s.db.QueryRowContext(ctx, `
-        SELECT id, version, data, created_at, updated_at 
-        FROM records 
-        WHERE id = ? 
-        ORDER BY version DESC 
+// getRecord returns the latest version of a record, including tombstones.
+func getRecord(ctx context.Context, q querier, collection string, id int) (entity.Record, error) {
+	record, err := scanRecord(q.QueryRowContext(ctx, `
+        SELECT `+recordColumns+`
+        FROM records
+        WHERE collection = ? AND id = ?
+        ORDER BY version DESC
         LIMIT 1
-    `, id).Scan(&record.ID, &record.Version, &dataJSON, &record.CreatedAt, &record.UpdatedAt)
+    `, collection, id))
 
 	if err == sql.ErrNoRows {
 		return entity.Record{}, ErrRecordDoesNotExist
@@ -81,22 +246,15 @@ func (s *SQLiteRecordService) GetRecord(ctx context.Context, id int) (entity.Rec
 		return entity.Record{}, fmt.Errorf("failed to get record: %w", err)
 	}
 
-	if err := json.Unmarshal([]byte(dataJSON), &record.Data); err != nil {
-		return entity.Record{}, fmt.Errorf("failed to unmarshal record data: %w", err)
-	}
-
 	return record, nil
 }
 
 func (s *SQLiteRecordService) GetRecordVersion(ctx context.Context, id, version int) (entity.Record, error) {
-	var record entity.Record
-	var dataJSON string
-
-	err := s.db.QueryRowContext(ctx, `
-        SELECT id, version, data, created_at, updated_at 
-        FROM records 
-        WHERE id = ? AND version = ?
-    `, id, version).Scan(&record.ID, &record.Version, &dataJSON, &record.CreatedAt, &record.UpdatedAt)
+	record, err := scanRecord(s.db.QueryRowContext(ctx, `
+        SELECT `+recordColumns+`
+        FROM records
+        WHERE collection = ? AND id = ? AND version = ?
+    `, s.collection, id, version))
 
 	if err == sql.ErrNoRows {
 		return entity.Record{}, ErrVersionNotFound
@@ -104,124 +262,359 @@ func (s *SQLiteRecordService) GetRecordVersion(ctx context.Context, id, version
 		return entity.Record{}, fmt.Errorf("failed to get record version: %w", err)
 	}
 
-	if err := json.Unmarshal([]byte(dataJSON), &record.Data); err != nil {
-		return entity.Record{}, fmt.Errorf("failed to unmarshal record data: %w", err)
+	return record, nil
+}
+
+func (s *SQLiteRecordService) GetRecordAsOf(ctx context.Context, id int, t time.Time) (entity.Record, error) {
+	record, err := scanRecord(s.db.QueryRowContext(ctx, `
+        SELECT `+recordColumns+`
+        FROM records
+        WHERE collection = ? AND id = ? AND recorded_at <= ?
+        ORDER BY version DESC
+        LIMIT 1
+    `, s.collection, id, t.UTC()))
+
+	if err == sql.ErrNoRows {
+		// Tell a record that was created after t apart from one that never was.
+		if _, err := getRecord(ctx, s.db, s.collection, id); err != nil {
+			return entity.Record{}, err
+		}
+		return entity.Record{}, ErrRecordNotYetCreated
+	} else if err != nil {
+		return entity.Record{}, fmt.Errorf("failed to get record as of %v: %w", t, err)
+	}
+
+	if record.Deleted {
+		return entity.Record{}, ErrRecordDeleted
 	}
 
 	return record, nil
 }
 
-func (s *SQLiteRecordService) CreateRecord(ctx context.Context, record entity.Record) error {
-	if record.ID <= 0 {
-		return ErrRecordIDInvalid
+func (s *SQLiteRecordService) GetRecordBitemporal(ctx context.Context, id int, effectiveAt, recordedAt time.Time) (entity.Record, error) {
+	// Of the versions we knew about at recordedAt, the latest one whose valid
+	// time covers effectiveAt wins: later versions are corrections.
+	record, err := scanRecord(s.db.QueryRowContext(ctx, `
+        SELECT `+recordColumns+`
+        FROM records
+        WHERE collection = ? AND id = ?
+          AND recorded_at <= ?
+          AND effective_from <= ?
+          AND (effective_to IS NULL OR effective_to > ?)
+        ORDER BY version DESC
+        LIMIT 1
+    `, s.collection, id, recordedAt.UTC(), effectiveAt.UTC(), effectiveAt.UTC()))
+
+	if err == sql.ErrNoRows {
+		return entity.Record{}, ErrVersionNotFound
+	} else if err != nil {
+		return entity.Record{}, fmt.Errorf("failed to get record: %w", err)
 	}
 
-	dataJSON, err := json.Marshal(record.Data)
-	if err != nil {
-		return fmt.Errorf("failed to marshal record data: %w", err)
+	if record.Deleted {
+		return entity.Record{}, ErrRecordDeleted
 	}
 
-	now := time.Now()
-	_, err = s.db.ExecContext(ctx, `
-        INSERT INTO records (id, version, data, created_at, updated_at) 
-        VALUES (?, 1, ?, ?, ?)
-    `, record.ID, string(dataJSON), now, now)
-	if err != nil {
-		return fmt.Errorf("failed to create record: %w", err)
+	return record, nil
+}
+
+func (s *SQLiteRecordService) CreateRecord(ctx context.Context, record entity.Record) error {
+	opts := WriteOptions{
+		EffectiveFrom: record.EffectiveFrom,
+		EffectiveTo:   record.EffectiveTo,
+		Author:        record.Author,
+		Reason:        record.Reason,
 	}
+	_, err := s.appendVersion(ctx, record.ID, opts, true, createMutation(record.Data))
+	return err
+}
 
-	return nil
+func (s *SQLiteRecordService) UpdateRecord(ctx context.Context, id int, updates map[string]interface{}) (entity.Record, error) {
+	return s.UpdateRecordWithVersion(ctx, id, updates, WriteOptions{})
+}
+
+func (s *SQLiteRecordService) UpdateRecordWithVersion(ctx context.Context, id int, updates map[string]interface{}, opts WriteOptions) (entity.Record, error) {
+	return s.appendVersion(ctx, id, opts, false, updateMutation(updates))
+}
+
+func (s *SQLiteRecordService) UpsertRecord(ctx context.Context, id int, updates map[string]interface{}, opts WriteOptions) (entity.Record, error) {
+	return s.appendVersion(ctx, id, opts, true, upsertMutation(updates))
+}
+
+func (s *SQLiteRecordService) PatchRecord(ctx context.Context, id int, patch Patch, opts WriteOptions) (entity.Record, error) {
+	opts.singleVersion = true
+	return s.appendVersion(ctx, id, opts, true, patchMutation(patch))
+}
+
+func (s *SQLiteRecordService) DeleteRecord(ctx context.Context, id int, opts WriteOptions) (entity.Record, error) {
+	return s.appendVersion(ctx, id, opts, false, deleteMutation)
 }
 
-func (s *SQLiteRecordService) UpdateRecord(ctx context.Context, id int, updates map[string]*string) (entity.Record, error) {
-	record, err := s.GetRecord(ctx, id)
+func (s *SQLiteRecordService) RestoreRecord(ctx context.Context, id int, opts WriteOptions) (entity.Record, error) {
+	return s.appendVersion(ctx, id, opts, false, restoreMutation)
+}
+
+func (s *SQLiteRecordService) RevertRecord(ctx context.Context, id, version int, opts WriteOptions) (entity.Record, error) {
+	// Versions are never modified once written, so the target can be read
+	// outside the write transaction.
+	target, err := s.GetRecordVersion(ctx, id, version)
 	if err != nil {
 		return entity.Record{}, err
 	}
 
-	for key, value := range updates {
-		if value == nil {
-			delete(record.Data, key)
-		} else {
-			record.Data[key] = *value
-		}
+	return s.appendVersion(ctx, id, opts, false, revertMutation(target))
+}
+
+// appendVersion applies mutate to a record as described by nextVersions and
+// stores the result, returning the last version appended.
+func (s *SQLiteRecordService) appendVersion(ctx context.Context, id int, opts WriteOptions, create bool, mutate func(record *entity.Record) error) (entity.Record, error) {
+	if id <= 0 {
+		return entity.Record{}, ErrRecordIDInvalid
 	}
 
-	dataJSON, err := json.Marshal(record.Data)
+	// The read-modify-write happens in a single transaction. The connection
+	// uses BEGIN IMMEDIATE, so concurrent writers queue up here instead of
+	// racing for the next version number.
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return entity.Record{}, fmt.Errorf("failed to marshal updated record data: %w", err)
+		return entity.Record{}, fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	now := time.Now()
-	_, err = s.db.ExecContext(ctx, `
-        INSERT INTO records (id, version, data, created_at, updated_at) 
-        VALUES (?, ?, ?, ?, ?)
-    `, id, record.Version+1, string(dataJSON), record.CreatedAt, now)
+	// The time is taken once the write lock is held, so that versions are
+	// recorded and take effect in the order they are written.
+	now := time.Now().UTC()
+
+	history, err := getHistory(ctx, tx, s.collection, id)
 	if err != nil {
-		return entity.Record{}, fmt.Errorf("failed to update record: %w", err)
+		return entity.Record{}, err
 	}
 
-	record.Version++
-	record.UpdatedAt = now
-	return record, nil
-}
+	schema, err := latestSchema(ctx, tx, s.collection)
+	if err != nil {
+		return entity.Record{}, err
+	}
 
-func (s *SQLiteRecordService) UpdateRecordWithVersion(ctx context.Context, id int, updates map[string]*string) (entity.Record, error) {
-	record, err := s.GetRecord(ctx, id)
+	versions, err := nextVersions(history, s.collection, id, now, opts, create, schema, mutate)
 	if err != nil {
 		return entity.Record{}, err
 	}
 
-	for key, value := range updates {
-		if value == nil {
-			delete(record.Data, key)
-		} else {
-			record.Data[key] = *value
+	if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO collections (name) VALUES (?)", s.collection); err != nil {
+		return entity.Record{}, fmt.Errorf("failed to create collection: %w", err)
+	}
+
+	for _, record := range versions {
+		if err := insertVersion(ctx, tx, record); err != nil {
+			return entity.Record{}, fmt.Errorf("failed to write record version: %w", err)
+		}
+
+		if err := indexVersion(ctx, tx, record); err != nil {
+			return entity.Record{}, fmt.Errorf("failed to index record version: %w", err)
+		}
+
+		if err := indexSearch(ctx, tx, record); err != nil {
+			return entity.Record{}, fmt.Errorf("failed to index record version for search: %w", err)
 		}
 	}
 
-	dataJSON, err := json.Marshal(record.Data)
+	if err := tx.Commit(); err != nil {
+		return entity.Record{}, fmt.Errorf("failed to commit record version: %w", err)
+	}
+
+	return versions[len(versions)-1], nil
+}
+
+func (s *SQLiteRecordService) GetRecordVersions(ctx context.Context, id int) ([]entity.VersionInfo, error) {
+	history, err := s.GetRecordHistory(ctx, id)
 	if err != nil {
-		return entity.Record{}, fmt.Errorf("failed to marshal updated record data: %w", err)
+		return nil, err
 	}
 
-	now := time.Now()
-	_, err = s.db.ExecContext(ctx, `
-        INSERT INTO records (id, version, data, created_at, updated_at) 
-        VALUES (?, ?, ?, ?, ?)
-    `, id, record.Version+1, string(dataJSON), record.CreatedAt, now)
+	return describeVersions(history)
+}
+
+func (s *SQLiteRecordService) GetRecordHistory(ctx context.Context, id int) ([]entity.Record, error) {
+	history, err := getHistory(ctx, s.db, s.collection, id)
 	if err != nil {
-		return entity.Record{}, fmt.Errorf("failed to update record: %w", err)
+		return nil, err
 	}
 
-	record.Version++
-	record.UpdatedAt = now
-	return record, nil
+	if len(history) == 0 {
+		return nil, ErrRecordDoesNotExist
+	}
+
+	return history, nil
 }
 
-func (s *SQLiteRecordService) GetRecordVersions(ctx context.Context, id int) ([]int, error) {
-	rows, err := s.db.QueryContext(ctx, "SELECT version FROM records WHERE id = ? ORDER BY version", id)
+// getHistory returns every version of a record, oldest first, and none if it
+// does not exist.
+func getHistory(ctx context.Context, q querier, collection string, id int) ([]entity.Record, error) {
+	rows, err := q.QueryContext(ctx, "SELECT "+recordColumns+" FROM records WHERE collection = ? AND id = ? ORDER BY version", collection, id)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get record versions: %w", err)
 	}
 	defer rows.Close()
 
-	var versions []int
+	var history []entity.Record
 	for rows.Next() {
-		var version int
-		if err := rows.Scan(&version); err != nil {
+		record, err := scanRecord(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan version: %w", err)
 		}
-		versions = append(versions, version)
+		history = append(history, record)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating over versions: %w", err)
 	}
 
-	if len(versions) == 0 {
-		return nil, ErrRecordDoesNotExist
+	return history, nil
+}
+
+func (s *SQLiteRecordService) ListRecords(ctx context.Context, opts ListOptions) (RecordPage, error) {
+	cursor, err := opts.normalize()
+	if err != nil {
+		return RecordPage{}, err
+	}
+
+	// The subquery picks the version of each record the options consider.
+	version := "SELECT MAX(version) FROM records WHERE collection = r.collection AND id = r.id"
+	var args []interface{}
+	if !opts.AsOf.IsZero() {
+		version += " AND recorded_at <= ?"
+		args = append(args, opts.AsOf.UTC())
+	}
+	if !opts.EffectiveAt.IsZero() {
+		version += " AND effective_from <= ? AND (effective_to IS NULL OR effective_to > ?)"
+		args = append(args, opts.EffectiveAt.UTC(), opts.EffectiveAt.UTC())
+	}
+
+	query := `
+        SELECT ` + recordColumns + `
+        FROM records r
+        WHERE version = (` + version + `)
+          AND deleted = 0
+          AND collection = ?`
+	args = append(args, s.collection)
+
+	// Filters on indexed keys narrow down the records to look at. They are
+	// still evaluated below, as the index covers every version.
+	indexed, err := indexedKeys(ctx, s.db)
+	if err != nil {
+		return RecordPage{}, err
+	}
+	for _, filter := range opts.Filters {
+		if condition, conditionArgs, ok := indexCondition(filter, indexed); ok {
+			query += " AND id IN (SELECT id FROM record_index WHERE collection = r.collection AND " + condition + ")"
+			args = append(args, conditionArgs...)
+		}
+	}
+
+	if !opts.UpdatedSince.IsZero() {
+		query += " AND recorded_at >= ?"
+		args = append(args, opts.UpdatedSince.UTC())
+	}
+
+	op, order := ">", "ASC"
+	if opts.Descending {
+		op, order = "<", "DESC"
+	}
+
+	switch opts.SortBy {
+	case SortByID:
+		if cursor != nil {
+			query += " AND id " + op + " ?"
+			args = append(args, cursor.ID)
+		}
+		query += " ORDER BY id " + order
+	case SortByUpdatedAt:
+		if cursor != nil {
+			query += " AND (recorded_at " + op + " ? OR (recorded_at = ? AND id " + op + " ?))"
+			args = append(args, cursor.UpdatedAt, cursor.UpdatedAt, cursor.ID)
+		}
+		query += " ORDER BY recorded_at " + order + ", id " + order
+	}
+
+	// Fetch one extra row to learn whether there is a next page. Filters are
+	// evaluated here rather than in SQL, so then rows are read until enough
+	// of them match.
+	if len(opts.Filters) == 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit+1)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return RecordPage{}, fmt.Errorf("failed to list records: %w", err)
+	}
+	defer rows.Close()
+
+	page := RecordPage{Records: []entity.Record{}}
+	for len(page.Records) <= opts.Limit && rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return RecordPage{}, fmt.Errorf("failed to scan record: %w", err)
+		}
+		if matchAll(opts.Filters, record.Data) {
+			page.Records = append(page.Records, record)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return RecordPage{}, fmt.Errorf("error iterating over records: %w", err)
+	}
+
+	if len(page.Records) > opts.Limit {
+		page.Records = page.Records[:opts.Limit]
+		page.NextCursor = encodeCursor(page.Records[opts.Limit-1])
 	}
 
-	return versions, nil
-}
\ No newline at end of file
+	return page, nil
+}
+
+// insertVersion writes record as a new row of the records table.
+func insertVersion(ctx context.Context, q querier, record entity.Record) error {
+	dataJSON, err := json.Marshal(record.Data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record data: %w", err)
+	}
+
+	_, err = q.ExecContext(ctx, `
+        INSERT INTO records (
+            collection, id, version, data, created_at, updated_at, recorded_at, effective_from,
+            effective_to, deleted, author, reason, schema_version
+        )
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, record.Collection, record.ID, record.Version, string(dataJSON), record.CreatedAt, record.UpdatedAt,
+		record.RecordedAt, record.EffectiveFrom, record.EffectiveTo,
+		record.Deleted, record.Author, record.Reason, record.SchemaVersion)
+	return err
+}
+
+// checkVersion fails with a VersionConflictError if the caller expected a
+// different current version. A record that does not exist yet is at version 0.
+func (o WriteOptions) checkVersion(current int) error {
+	if o.ExpectedVersion != 0 && o.ExpectedVersion != current {
+		return &VersionConflictError{Expected: o.ExpectedVersion, Current: current}
+	}
+	return nil
+}
+
+// validity resolves the valid time of a version written at now.
+func (o WriteOptions) validity(now time.Time) (time.Time, *time.Time, error) {
+	from := now
+	if !o.EffectiveFrom.IsZero() {
+		from = o.EffectiveFrom.UTC()
+	}
+
+	if o.EffectiveTo == nil {
+		return from, nil, nil
+	}
+
+	to := o.EffectiveTo.UTC()
+	if !to.After(from) {
+		return time.Time{}, nil, ErrInvalidValidity
+	}
+	return from, &to, nil
+}
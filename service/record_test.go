@@ -0,0 +1,26 @@
+package service_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/rainbowmga/timetravel/service"
+	"github.com/rainbowmga/timetravel/service/servicetest"
+)
+
+func TestSQLiteRecordService(t *testing.T) {
+	servicetest.RunRecordServiceSuite(t, func(t *testing.T) service.RecordService {
+		s, err := service.NewSQLiteRecordService(filepath.Join(t.TempDir(), "records.db"))
+		if err != nil {
+			t.Fatalf("Failed to create SQLite service: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestInMemoryRecordService(t *testing.T) {
+	servicetest.RunRecordServiceSuite(t, func(t *testing.T) service.RecordService {
+		return service.NewInMemoryRecordService()
+	})
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+var (
+	ErrInvalidReference = errors.New(`references must be written as {"$ref": "<collection>/<id>"}`)
+	ErrNotAReference    = errors.New("value is not a reference or a list of references")
+)
+
+// parseReference reports whether value is a reference object, and returns
+// the reference if it is well formed.
+func parseReference(value interface{}) (entity.Reference, bool, error) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return entity.Reference{}, false, nil
+	}
+	ref, ok := object[entity.ReferenceKey]
+	if !ok {
+		return entity.Reference{}, false, nil
+	}
+
+	target, ok := ref.(string)
+	if !ok || len(object) != 1 {
+		return entity.Reference{}, true, ErrInvalidReference
+	}
+	parts := strings.SplitN(target, "/", 2)
+	if len(parts) != 2 || validateCollection(parts[0]) != nil {
+		return entity.Reference{}, true, ErrInvalidReference
+	}
+	idNumber, err := strconv.ParseInt(parts[1], 10, 32)
+	if err != nil || idNumber <= 0 {
+		return entity.Reference{}, true, ErrInvalidReference
+	}
+
+	return entity.Reference{Collection: parts[0], ID: int(idNumber)}, true, nil
+}
+
+// checkReferences fails if any object in data, however deeply nested, looks
+// like a reference but is not a well formed one.
+func checkReferences(data map[string]interface{}) error {
+	for _, key := range sortedDataKeys(data) {
+		if err := checkReference(data[key], "/"+escapePointer(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkReference(value interface{}, path string) error {
+	if _, ok, err := parseReference(value); ok {
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, path)
+		}
+		return nil
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedDataKeys(v) {
+			if err := checkReference(v[key], path+"/"+escapePointer(key)); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			if err := checkReference(item, path+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ExpandOptions selects the keys of record data whose references are
+// resolved, and when to resolve them. The zero time reads the latest version
+// of each referenced record.
+type ExpandOptions struct {
+	Keys []string
+	// AsOf reads referenced records as they were recorded at that time, as
+	// GetRecordAsOf does.
+	AsOf time.Time
+	// EffectiveAt and KnownAt read referenced records bitemporally, as
+	// GetRecordBitemporal does. They are used if EffectiveAt is set.
+	EffectiveAt time.Time
+	KnownAt     time.Time
+}
+
+// ExpandReferences resolves the references held by the given keys of data,
+// which must each be a reference or a list of references. The result maps
+// each key present in data to the referenced record, or to a list of them.
+// A record that did not exist at the time asked for, or was deleted, is nil.
+func ExpandReferences(ctx context.Context, s RecordService, data map[string]interface{}, opts ExpandOptions) (map[string]interface{}, error) {
+	expanded := make(map[string]interface{}, len(opts.Keys))
+	for _, key := range opts.Keys {
+		value, ok := data[key]
+		if !ok {
+			continue
+		}
+
+		if ref, ok, err := parseReference(value); ok {
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", err, key)
+			}
+			record, err := resolveReference(ctx, s, ref, opts)
+			if err != nil {
+				return nil, err
+			}
+			expanded[key] = record
+			continue
+		}
+
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNotAReference, key)
+		}
+		records := make([]*entity.Record, len(items))
+		for i, item := range items {
+			ref, ok, err := parseReference(item)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", ErrNotAReference, key)
+			} else if err != nil {
+				return nil, fmt.Errorf("%w: %s/%d", err, key, i)
+			}
+			if records[i], err = resolveReference(ctx, s, ref, opts); err != nil {
+				return nil, err
+			}
+		}
+		expanded[key] = records
+	}
+	return expanded, nil
+}
+
+func resolveReference(ctx context.Context, s RecordService, ref entity.Reference, opts ExpandOptions) (*entity.Record, error) {
+	records, err := s.Collection(ref.Collection)
+	if err != nil {
+		return nil, err
+	}
+
+	var record entity.Record
+	switch {
+	case !opts.EffectiveAt.IsZero():
+		record, err = records.GetRecordBitemporal(ctx, ref.ID, opts.EffectiveAt, opts.KnownAt)
+	case !opts.AsOf.IsZero():
+		record, err = records.GetRecordAsOf(ctx, ref.ID, opts.AsOf)
+	default:
+		record, err = records.GetRecord(ctx, ref.ID)
+	}
+
+	if errors.Is(err, ErrRecordDoesNotExist) || errors.Is(err, ErrRecordNotYetCreated) || errors.Is(err, ErrVersionNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", ref, err)
+	}
+	return &record, nil
+}
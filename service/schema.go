@@ -0,0 +1,400 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+var (
+	ErrSchemaNotFound   = errors.New("schema not found")
+	ErrInvalidSchema    = errors.New("invalid schema")
+	ErrSchemaValidation = errors.New("record does not match the collection schema")
+)
+
+// FieldError is a single reason a record does not match a schema. Path is a
+// JSON Pointer to the offending value; the empty path is the whole record.
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// SchemaValidationError is returned when a new version of a record does not
+// match its collection's schema. It matches ErrSchemaValidation.
+type SchemaValidationError struct {
+	SchemaVersion int
+	Errors        []FieldError
+}
+
+func (e *SchemaValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, fieldError := range e.Errors {
+		messages[i] = fmt.Sprintf("%s: %s", fieldError.Path, fieldError.Message)
+	}
+	return fmt.Sprintf("%v (version %d): %s", ErrSchemaValidation, e.SchemaVersion, strings.Join(messages, "; "))
+}
+
+func (e *SchemaValidationError) Is(target error) bool {
+	return target == ErrSchemaValidation
+}
+
+// The supported subset of JSON Schema. Other keywords are rejected rather than
+// ignored, so that a schema never promises more than is checked.
+var (
+	schemaAnnotations = map[string]bool{
+		"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+		"default": true, "examples": true, "deprecated": true, "readOnly": true, "writeOnly": true,
+	}
+	schemaTypes = map[string]bool{
+		"object": true, "array": true, "string": true, "number": true, "integer": true, "boolean": true, "null": true,
+	}
+)
+
+// parseSchema decodes a JSON Schema and checks that it only uses supported
+// keywords.
+func parseSchema(raw []byte) (interface{}, error) {
+	var schema interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&schema); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+	if _, ok := schema.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("%w: must be an object", ErrInvalidSchema)
+	}
+	if err := checkSchema(schema, ""); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func checkSchema(schema interface{}, path string) error {
+	if _, ok := schema.(bool); ok {
+		return nil
+	}
+	object, ok := schema.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: %s must be an object or a boolean", ErrInvalidSchema, schemaPath(path))
+	}
+
+	for keyword, value := range object {
+		at := path + "/" + keyword
+		invalid := func(expected string) error {
+			return fmt.Errorf("%w: %s must be %s", ErrInvalidSchema, at, expected)
+		}
+
+		switch keyword {
+		case "type":
+			types, ok := value.([]interface{})
+			if !ok {
+				types = []interface{}{value}
+			}
+			for _, t := range types {
+				if name, ok := t.(string); !ok || !schemaTypes[name] {
+					return invalid("a JSON type or a list of them")
+				}
+			}
+		case "properties":
+			properties, ok := value.(map[string]interface{})
+			if !ok {
+				return invalid("an object")
+			}
+			for name, property := range properties {
+				if err := checkSchema(property, at+"/"+escapePointer(name)); err != nil {
+					return err
+				}
+			}
+		case "required":
+			names, ok := value.([]interface{})
+			if !ok {
+				return invalid("a list of strings")
+			}
+			for _, name := range names {
+				if _, ok := name.(string); !ok {
+					return invalid("a list of strings")
+				}
+			}
+		case "additionalProperties", "items", "not":
+			if err := checkSchema(value, at); err != nil {
+				return err
+			}
+		case "allOf", "anyOf", "oneOf":
+			schemas, ok := value.([]interface{})
+			if !ok || len(schemas) == 0 {
+				return invalid("a non-empty list of schemas")
+			}
+			for i, s := range schemas {
+				if err := checkSchema(s, at+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		case "enum":
+			if _, ok := value.([]interface{}); !ok {
+				return invalid("a list")
+			}
+		case "const", "format":
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum":
+			if _, ok := schemaNumber(value); !ok {
+				return invalid("a number")
+			}
+		case "minLength", "maxLength", "minItems", "maxItems":
+			if n, ok := schemaNumber(value); !ok || n < 0 || n != math.Trunc(n) {
+				return invalid("a non-negative integer")
+			}
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return invalid("a string")
+			}
+			if _, err := regexp.Compile(pattern); err != nil {
+				return invalid("a valid regular expression")
+			}
+		default:
+			if !schemaAnnotations[keyword] {
+				return fmt.Errorf("%w: %s: unsupported keyword", ErrInvalidSchema, at)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateSchema appends to fieldErrors every way in which value, found at path,
+// does not match schema. The schema must have been checked by parseSchema.
+func validateSchema(schema, value interface{}, path string, fieldErrors []FieldError) []FieldError {
+	if accept, ok := schema.(bool); ok {
+		if !accept {
+			fieldErrors = append(fieldErrors, FieldError{path, "is not allowed"})
+		}
+		return fieldErrors
+	}
+	rules := schema.(map[string]interface{})
+	fail := func(format string, args ...interface{}) {
+		fieldErrors = append(fieldErrors, FieldError{path, fmt.Sprintf(format, args...)})
+	}
+
+	if t, ok := rules["type"]; ok {
+		types, ok := t.([]interface{})
+		if !ok {
+			types = []interface{}{t}
+		}
+		matched := false
+		names := make([]string, len(types))
+		for i, name := range types {
+			names[i] = name.(string)
+			matched = matched || hasType(value, names[i])
+		}
+		if !matched {
+			fail("must be of type %s, not %s", strings.Join(names, " or "), typeOf(value))
+			// The remaining keywords would only repeat the type mismatch.
+			return fieldErrors
+		}
+	}
+
+	if enum, ok := rules["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			found = found || jsonEqual(value, allowed)
+		}
+		if !found {
+			fail("must be one of the allowed values")
+		}
+	}
+	if constant, ok := rules["const"]; ok && !jsonEqual(value, constant) {
+		fail("must equal %s", entity.ValueString(constant))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := rules["properties"].(map[string]interface{})
+		if required, ok := rules["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := v[name.(string)]; !ok {
+					fieldErrors = append(fieldErrors, FieldError{path + "/" + escapePointer(name.(string)), "is required"})
+				}
+			}
+		}
+		for _, key := range sortedDataKeys(v) {
+			if property, ok := properties[key]; ok {
+				fieldErrors = validateSchema(property, v[key], path+"/"+escapePointer(key), fieldErrors)
+			} else if additional, ok := rules["additionalProperties"]; ok {
+				fieldErrors = validateSchema(additional, v[key], path+"/"+escapePointer(key), fieldErrors)
+			}
+		}
+	case []interface{}:
+		if n, ok := schemaNumber(rules["minItems"]); ok && float64(len(v)) < n {
+			fail("must have at least %v items", n)
+		}
+		if n, ok := schemaNumber(rules["maxItems"]); ok && float64(len(v)) > n {
+			fail("must have at most %v items", n)
+		}
+		if items, ok := rules["items"]; ok {
+			for i, item := range v {
+				fieldErrors = validateSchema(items, item, path+"/"+strconv.Itoa(i), fieldErrors)
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if n, ok := schemaNumber(rules["minLength"]); ok && length < n {
+			fail("must be at least %v characters long", n)
+		}
+		if n, ok := schemaNumber(rules["maxLength"]); ok && length > n {
+			fail("must be at most %v characters long", n)
+		}
+		if pattern, ok := rules["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(v) {
+			fail("must match the pattern %q", pattern)
+		}
+		if format, ok := rules["format"].(string); ok && !matchFormat(format, v) {
+			fail("must be a valid %s", format)
+		}
+	case json.Number:
+		x, _ := schemaNumber(v)
+		if n, ok := schemaNumber(rules["minimum"]); ok && x < n {
+			fail("must be at least %v", n)
+		}
+		if n, ok := schemaNumber(rules["maximum"]); ok && x > n {
+			fail("must be at most %v", n)
+		}
+		if n, ok := schemaNumber(rules["exclusiveMinimum"]); ok && x <= n {
+			fail("must be greater than %v", n)
+		}
+		if n, ok := schemaNumber(rules["exclusiveMaximum"]); ok && x >= n {
+			fail("must be less than %v", n)
+		}
+	}
+
+	if all, ok := rules["allOf"].([]interface{}); ok {
+		for _, s := range all {
+			fieldErrors = validateSchema(s, value, path, fieldErrors)
+		}
+	}
+	if anyOf, ok := rules["anyOf"].([]interface{}); ok && countMatches(anyOf, value, path) == 0 {
+		fail("must match at least one of the allowed schemas")
+	}
+	if oneOf, ok := rules["oneOf"].([]interface{}); ok && countMatches(oneOf, value, path) != 1 {
+		fail("must match exactly one of the allowed schemas")
+	}
+	if not, ok := rules["not"]; ok && len(validateSchema(not, value, path, nil)) == 0 {
+		fail("must not match the disallowed schema")
+	}
+
+	return fieldErrors
+}
+
+func countMatches(schemas []interface{}, value interface{}, path string) int {
+	matches := 0
+	for _, s := range schemas {
+		if len(validateSchema(s, value, path, nil)) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+func hasType(value interface{}, name string) bool {
+	switch name {
+	case "integer":
+		x, ok := schemaNumber(value)
+		return ok && x == math.Trunc(x)
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	default:
+		return typeOf(value) == name
+	}
+}
+
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// schemaNumber reads a number decoded from JSON.
+func schemaNumber(value interface{}) (float64, bool) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	return parseNumber(number.String())
+}
+
+// matchFormat checks the formats that matter for records. Other formats are
+// annotations and always match.
+func matchFormat(format, value string) bool {
+	switch format {
+	case "date":
+		_, err := time.Parse("2006-01-02", value)
+		return err == nil
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, value)
+		return err == nil
+	case "email":
+		at := strings.LastIndex(value, "@")
+		return at > 0 && at < len(value)-1 && !strings.ContainsAny(value, " \t\n")
+	default:
+		return true
+	}
+}
+
+func escapePointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// schemaPath names a location within a schema in error messages.
+func schemaPath(path string) string {
+	if path == "" {
+		return "the schema"
+	}
+	return path
+}
+
+func sortedDataKeys(data map[string]interface{}) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkData validates the data of a new version against the latest schema of
+// its collection, if any, and returns the version of the schema used.
+func checkData(schema *entity.Schema, data map[string]interface{}) (int, error) {
+	if schema == nil {
+		return 0, nil
+	}
+
+	parsed, err := parseSchema(schema.Schema)
+	if err != nil {
+		return 0, err
+	}
+
+	if fieldErrors := validateSchema(parsed, data, "", nil); len(fieldErrors) > 0 {
+		return 0, &SchemaValidationError{SchemaVersion: schema.Version, Errors: fieldErrors}
+	}
+	return schema.Version, nil
+}
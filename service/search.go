@@ -0,0 +1,228 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+var ErrEmptySearch = errors.New("search query must contain at least one word")
+
+// SearchOptions selects the records SearchRecords returns.
+type SearchOptions struct {
+	// Query is a list of words that must all occur in the values of a
+	// record's data, ignoring case. A word ending in * matches any word it
+	// is a prefix of.
+	Query string
+	// AllVersions searches every version of every record instead of only the
+	// latest ones. Tombstones are never returned.
+	AllVersions bool
+	// Limit caps the number of versions returned, DefaultListLimit if zero
+	// and at most MaxListLimit.
+	Limit int
+}
+
+// searchTerm is a normalized word of a search query.
+type searchTerm struct {
+	word   string
+	prefix bool
+}
+
+// parseSearchQuery splits a query into the words the full-text index holds.
+func parseSearchQuery(query string) ([]searchTerm, error) {
+	var terms []searchTerm
+	for _, field := range strings.Fields(query) {
+		words := searchWords(field)
+		for i, word := range words {
+			terms = append(terms, searchTerm{
+				word:   word,
+				prefix: i == len(words)-1 && strings.HasSuffix(field, "*"),
+			})
+		}
+	}
+
+	if len(terms) == 0 {
+		return nil, ErrEmptySearch
+	}
+	return terms, nil
+}
+
+// searchWords splits text into lower case words the way SQLite's unicode61
+// tokenizer does. Diacritics are kept, so the tokenizer is configured not to
+// remove them either.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchValues appends the scalar values found in value, descending into
+// arrays and objects. Keys are not searched.
+func searchValues(values []string, value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+	case map[string]interface{}:
+		for _, item := range v {
+			values = searchValues(values, item)
+		}
+	case []interface{}:
+		for _, item := range v {
+			values = searchValues(values, item)
+		}
+	default:
+		values = append(values, entity.ValueString(v))
+	}
+	return values
+}
+
+// searchContent is the text of a version that is searched.
+func searchContent(record entity.Record) string {
+	values := searchValues(nil, record.Data)
+	sort.Strings(values)
+	return strings.Join(values, "\n")
+}
+
+// matchSearch reports whether every term occurs in the record's values.
+func matchSearch(record entity.Record, terms []searchTerm) bool {
+	words := map[string]bool{}
+	for _, value := range searchValues(nil, record.Data) {
+		for _, word := range searchWords(value) {
+			words[word] = true
+		}
+	}
+
+	for _, term := range terms {
+		if words[term.word] {
+			continue
+		}
+		found := false
+		if term.prefix {
+			for word := range words {
+				if strings.HasPrefix(word, term.word) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchExpression builds an FTS query from terms. Words only contain letters
+// and digits and are lower case, so they can never be read as operators.
+func matchExpression(terms []searchTerm) string {
+	words := make([]string, len(terms))
+	for i, term := range terms {
+		words[i] = term.word
+		if term.prefix {
+			words[i] += "*"
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// createSearchTable creates the full-text index of record values with
+// searchTableSQL if it does not exist yet, and fills it from the stored
+// versions. An existing index is kept as it was created.
+func createSearchTable(db *sql.DB) error {
+	var exists int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'record_search'").Scan(&exists)
+	if err != nil || exists > 0 {
+		return err
+	}
+
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(searchTableSQL); err != nil {
+		return err
+	}
+
+	records, err := allVersions(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := indexSearch(ctx, tx, record); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// indexSearch adds a version to the full-text index.
+func indexSearch(ctx context.Context, q querier, record entity.Record) error {
+	if record.Deleted {
+		return nil
+	}
+
+	_, err := q.ExecContext(ctx, `
+        INSERT INTO record_search (record_collection, record_id, record_version, content)
+        VALUES (?, ?, ?, ?)
+    `, record.Collection, record.ID, record.Version, searchContent(record))
+	return err
+}
+
+func (s *SQLiteRecordService) SearchRecords(ctx context.Context, opts SearchOptions) ([]entity.Record, error) {
+	terms, err := parseSearchQuery(opts.Query)
+	if err != nil {
+		return nil, err
+	}
+	opts.normalize()
+
+	query := `
+        SELECT ` + recordColumns + `
+        FROM record_search s
+        JOIN records r
+          ON r.collection = s.record_collection AND r.id = s.record_id AND r.version = s.record_version
+        WHERE record_search MATCH ?
+          AND collection = ?
+          AND deleted = 0`
+	if !opts.AllVersions {
+		query += " AND version = (SELECT MAX(version) FROM records WHERE collection = r.collection AND id = r.id)"
+	}
+	query += " ORDER BY id, version LIMIT ?"
+
+	rows, err := s.db.QueryContext(ctx, query, matchExpression(terms), s.collection, opts.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search records: %w", err)
+	}
+	defer rows.Close()
+
+	records := []entity.Record{}
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan record: %w", err)
+		}
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over records: %w", err)
+	}
+
+	return records, nil
+}
+
+func (o *SearchOptions) normalize() {
+	if o.Limit <= 0 {
+		o.Limit = DefaultListLimit
+	} else if o.Limit > MaxListLimit {
+		o.Limit = MaxListLimit
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !sqlite_fts5
+// +build !sqlite_fts5
+
+package service
+
+// searchTableSQL creates the full-text index with FTS4, which go-sqlite3
+// always includes. Diacritics are kept, as in searchWords.
+const searchTableSQL = `CREATE VIRTUAL TABLE record_search USING fts4(record_collection, record_id, record_version, content, notindexed=record_collection, notindexed=record_id, notindexed=record_version, tokenize=unicode61 "remove_diacritics=0")`
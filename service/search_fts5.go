@@ -0,0 +1,9 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package service
+
+// searchTableSQL creates the full-text index with FTS5, which go-sqlite3 only
+// includes when built with the sqlite_fts5 tag. Diacritics are kept, as in
+// searchWords.
+const searchTableSQL = `CREATE VIRTUAL TABLE record_search USING fts5(record_collection UNINDEXED, record_id UNINDEXED, record_version UNINDEXED, content, tokenize = "unicode61 remove_diacritics 0")`
@@ -0,0 +1,1610 @@
+// Package servicetest provides a conformance suite for implementations of
+// service.RecordService.
+package servicetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rainbowmga/timetravel/entity"
+	"github.com/rainbowmga/timetravel/service"
+)
+
+// Factory returns a new, empty RecordService for a single test.
+type Factory func(t *testing.T) service.RecordService
+
+// RunRecordServiceSuite checks that the services returned by newService
+// behave like SQLiteRecordService.
+func RunRecordServiceSuite(t *testing.T, newService Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s service.RecordService)
+	}{
+		{"CreateAndGet", testCreateAndGet},
+		{"CreateErrors", testCreateErrors},
+		{"UpdateAppendsVersions", testUpdateAppendsVersions},
+		{"UpdateDeletesNullKeys", testUpdateDeletesNullKeys},
+		{"UpdateMissingRecord", testUpdateMissingRecord},
+		{"GetRecordVersion", testGetRecordVersion},
+		{"GetRecordVersions", testGetRecordVersions},
+		{"GetRecordHistory", testGetRecordHistory},
+		{"GetRecordAsOf", testGetRecordAsOf},
+		{"GetRecordBitemporal", testGetRecordBitemporal},
+		{"BackdatedWrite", testBackdatedWrite},
+		{"LatestVersionIsCurrent", testLatestVersionIsCurrent},
+		{"InvalidValidity", testInvalidValidity},
+		{"Upsert", testUpsert},
+		{"ExpectedVersion", testExpectedVersion},
+		{"DeleteAndRestore", testDeleteAndRestore},
+		{"WriteAfterDelete", testWriteAfterDelete},
+		{"Revert", testRevert},
+		{"AuthorAndReason", testAuthorAndReason},
+		{"TypedValues", testTypedValues},
+		{"MergePatch", testMergePatch},
+		{"JSONPatch", testJSONPatch},
+		{"Collections", testCollections},
+		{"Schema", testSchema},
+		{"References", testReferences},
+		{"ListRecords", testListRecords},
+		{"ListRecordsErrors", testListRecordsErrors},
+		{"ListRecordsFilters", testListRecordsFilters},
+		{"ListRecordsAsOf", testListRecordsAsOf},
+		{"Indexes", testIndexes},
+		{"SearchRecords", testSearchRecords},
+		{"Snapshot", testSnapshot},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+		{"ConcurrentUpserts", testConcurrentUpserts},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newService(t))
+		})
+	}
+}
+
+// mustUpsert applies updates to record id and fails the test on error.
+func mustUpsert(t *testing.T, s service.RecordService, id int, updates map[string]interface{}) entity.Record {
+	t.Helper()
+	record, err := s.UpsertRecord(context.Background(), id, updates, service.WriteOptions{})
+	if err != nil {
+		t.Fatalf("UpsertRecord(%d): %v", id, err)
+	}
+	return record
+}
+
+func assertData(t *testing.T, record entity.Record, want map[string]interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(record.Data, want) {
+		t.Errorf("record %d version %d: got data %v, want %v", record.ID, record.Version, record.Data, want)
+	}
+}
+
+func testCreateAndGet(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	if _, err := s.GetRecord(ctx, 1); !errors.Is(err, service.ErrRecordDoesNotExist) {
+		t.Fatalf("GetRecord on empty service: got %v, want ErrRecordDoesNotExist", err)
+	}
+
+	err := s.CreateRecord(ctx, entity.Record{ID: 1, Data: map[string]interface{}{"name": "Acme"}})
+	if err != nil {
+		t.Fatalf("CreateRecord: %v", err)
+	}
+
+	record, err := s.GetRecord(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecord: %v", err)
+	}
+	if record.ID != 1 || record.Version != 1 {
+		t.Errorf("got id %d version %d, want id 1 version 1", record.ID, record.Version)
+	}
+	assertData(t, record, map[string]interface{}{"name": "Acme"})
+	if record.CreatedAt.IsZero() || record.RecordedAt.IsZero() || record.EffectiveFrom.IsZero() {
+		t.Errorf("expected timestamps to be set, got %+v", record)
+	}
+	if record.EffectiveTo != nil {
+		t.Errorf("expected an open-ended version, got effective_to %v", record.EffectiveTo)
+	}
+
+	// Callers must not be able to modify stored data through returned maps.
+	record.Data["name"] = "changed"
+	record, _ = s.GetRecord(ctx, 1)
+	assertData(t, record, map[string]interface{}{"name": "Acme"})
+}
+
+func testCreateErrors(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	for _, id := range []int{0, -1} {
+		err := s.CreateRecord(ctx, entity.Record{ID: id, Data: map[string]interface{}{}})
+		if !errors.Is(err, service.ErrRecordIDInvalid) {
+			t.Errorf("CreateRecord(%d): got %v, want ErrRecordIDInvalid", id, err)
+		}
+	}
+
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "1"})
+	err := s.CreateRecord(ctx, entity.Record{ID: 1, Data: map[string]interface{}{"a": "2"}})
+	if !errors.Is(err, service.ErrRecordAlreadyExists) {
+		t.Errorf("CreateRecord on existing record: got %v, want ErrRecordAlreadyExists", err)
+	}
+}
+
+func testUpdateAppendsVersions(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "1"})
+
+	record, err := s.UpdateRecord(ctx, 1, map[string]interface{}{"b": "2"})
+	if err != nil {
+		t.Fatalf("UpdateRecord: %v", err)
+	}
+	if record.Version != 2 {
+		t.Errorf("UpdateRecord: got version %d, want 2", record.Version)
+	}
+
+	record, err = s.UpdateRecordWithVersion(ctx, 1, map[string]interface{}{"a": "3"}, service.WriteOptions{})
+	if err != nil {
+		t.Fatalf("UpdateRecordWithVersion: %v", err)
+	}
+	if record.Version != 3 {
+		t.Errorf("UpdateRecordWithVersion: got version %d, want 3", record.Version)
+	}
+	assertData(t, record, map[string]interface{}{"a": "3", "b": "2"})
+
+	latest, err := s.GetRecord(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecord: %v", err)
+	}
+	if latest.Version != 3 || !latest.CreatedAt.Equal(record.CreatedAt) {
+		t.Errorf("GetRecord: got %+v, want the version returned by the update", latest)
+	}
+}
+
+func testUpdateDeletesNullKeys(t *testing.T, s service.RecordService) {
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "1", "b": "2"})
+
+	record := mustUpsert(t, s, 1, map[string]interface{}{"a": nil, "missing": nil})
+	assertData(t, record, map[string]interface{}{"b": "2"})
+
+	// Null keys in the first write are ignored.
+	record = mustUpsert(t, s, 2, map[string]interface{}{"a": nil, "b": "2"})
+	assertData(t, record, map[string]interface{}{"b": "2"})
+}
+
+func testUpdateMissingRecord(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	_, err := s.UpdateRecord(ctx, 1, map[string]interface{}{"a": "1"})
+	if !errors.Is(err, service.ErrRecordDoesNotExist) {
+		t.Errorf("UpdateRecord: got %v, want ErrRecordDoesNotExist", err)
+	}
+
+	_, err = s.UpdateRecordWithVersion(ctx, 1, map[string]interface{}{"a": "1"}, service.WriteOptions{})
+	if !errors.Is(err, service.ErrRecordDoesNotExist) {
+		t.Errorf("UpdateRecordWithVersion: got %v, want ErrRecordDoesNotExist", err)
+	}
+}
+
+func testGetRecordVersion(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "1"})
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "2"})
+
+	for version, want := range map[int]string{1: "1", 2: "2"} {
+		record, err := s.GetRecordVersion(ctx, 1, version)
+		if err != nil {
+			t.Fatalf("GetRecordVersion(%d): %v", version, err)
+		}
+		if record.Version != version {
+			t.Errorf("GetRecordVersion(%d): got version %d", version, record.Version)
+		}
+		assertData(t, record, map[string]interface{}{"a": want})
+	}
+
+	for _, c := range []struct{ id, version int }{{1, 0}, {1, 3}, {2, 1}} {
+		_, err := s.GetRecordVersion(ctx, c.id, c.version)
+		if !errors.Is(err, service.ErrVersionNotFound) {
+			t.Errorf("GetRecordVersion(%d, %d): got %v, want ErrVersionNotFound", c.id, c.version, err)
+		}
+	}
+}
+
+func testGetRecordVersions(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	if _, err := s.GetRecordVersions(ctx, 1); !errors.Is(err, service.ErrRecordDoesNotExist) {
+		t.Errorf("GetRecordVersions on missing record: got %v, want ErrRecordDoesNotExist", err)
+	}
+
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "1", "b": "1"})
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "2", "b": nil, "c": "3"})
+
+	versions, err := s.GetRecordVersions(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecordVersions: %v", err)
+	}
+	if len(versions) != 2 || versions[0].Version != 1 || versions[1].Version != 2 {
+		t.Fatalf("GetRecordVersions: got %+v, want versions 1 and 2", versions)
+	}
+	if want := []string{"c", "a", "b"}; !reflect.DeepEqual(versions[1].KeysTouched, want) {
+		t.Errorf("version 2 keys touched: got %v, want %v", versions[1].KeysTouched, want)
+	}
+	if versions[1].Size != len(`{"a":"2","c":"3"}`) {
+		t.Errorf("version 2 size: got %d", versions[1].Size)
+	}
+}
+
+func testGetRecordHistory(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	if _, err := s.GetRecordHistory(ctx, 1); !errors.Is(err, service.ErrRecordDoesNotExist) {
+		t.Errorf("GetRecordHistory on missing record: got %v, want ErrRecordDoesNotExist", err)
+	}
+
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "1"})
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "2"})
+
+	history, err := s.GetRecordHistory(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecordHistory: %v", err)
+	}
+	if len(history) != 2 || history[0].Version != 1 || history[1].Version != 2 {
+		t.Fatalf("GetRecordHistory: got %+v, want versions 1 and 2", history)
+	}
+	assertData(t, history[0], map[string]interface{}{"a": "1"})
+	assertData(t, history[1], map[string]interface{}{"a": "2"})
+}
+
+func testGetRecordAsOf(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	if _, err := s.GetRecordAsOf(ctx, 1, time.Now()); !errors.Is(err, service.ErrRecordDoesNotExist) {
+		t.Errorf("GetRecordAsOf on missing record: got %v, want ErrRecordDoesNotExist", err)
+	}
+
+	beforeCreate := time.Now()
+	first := mustUpsert(t, s, 1, map[string]interface{}{"a": "1"})
+	second := mustUpsert(t, s, 1, map[string]interface{}{"a": "2"})
+
+	if _, err := s.GetRecordAsOf(ctx, 1, beforeCreate); !errors.Is(err, service.ErrRecordNotYetCreated) {
+		t.Errorf("GetRecordAsOf before creation: got %v, want ErrRecordNotYetCreated", err)
+	}
+
+	for _, c := range []struct {
+		at      time.Time
+		version int
+	}{
+		{first.RecordedAt, 1},
+		{second.RecordedAt.Add(-time.Nanosecond), 1},
+		{second.RecordedAt, 2},
+		{time.Now().Add(time.Hour), 2},
+	} {
+		record, err := s.GetRecordAsOf(ctx, 1, c.at)
+		if err != nil {
+			t.Fatalf("GetRecordAsOf(%v): %v", c.at, err)
+		}
+		if record.Version != c.version {
+			t.Errorf("GetRecordAsOf(%v): got version %d, want %d", c.at, record.Version, c.version)
+		}
+	}
+}
+
+func testGetRecordBitemporal(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+	jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	_, err := s.UpsertRecord(ctx, 1, map[string]interface{}{"address": "old"}, service.WriteOptions{EffectiveFrom: jan})
+	if err != nil {
+		t.Fatalf("UpsertRecord: %v", err)
+	}
+	beforeCorrection := time.Now()
+	correction, err := s.UpsertRecord(ctx, 1, map[string]interface{}{"address": "new"}, service.WriteOptions{EffectiveFrom: mar})
+	if err != nil {
+		t.Fatalf("UpsertRecord: %v", err)
+	}
+	if !correction.EffectiveFrom.Equal(mar) {
+		t.Errorf("got effective_from %v, want %v", correction.EffectiveFrom, mar)
+	}
+
+	now := time.Now()
+	for _, c := range []struct {
+		effectiveAt, knownAt time.Time
+		version              int
+	}{
+		{jan.AddDate(0, 1, 0), now, 1},
+		{mar, now, 2},
+		{mar.AddDate(0, 1, 0), beforeCorrection, 1},
+	} {
+		record, err := s.GetRecordBitemporal(ctx, 1, c.effectiveAt, c.knownAt)
+		if err != nil {
+			t.Fatalf("GetRecordBitemporal(%v, %v): %v", c.effectiveAt, c.knownAt, err)
+		}
+		if record.Version != c.version {
+			t.Errorf("GetRecordBitemporal(%v, %v): got version %d, want %d", c.effectiveAt, c.knownAt, record.Version, c.version)
+		}
+	}
+
+	if _, err := s.GetRecordBitemporal(ctx, 1, jan.Add(-time.Hour), now); !errors.Is(err, service.ErrVersionNotFound) {
+		t.Errorf("GetRecordBitemporal before valid time: got %v, want ErrVersionNotFound", err)
+	}
+
+	// A bounded version stops being effective at effective_to.
+	end := mar.AddDate(0, 6, 0)
+	_, err = s.UpsertRecord(ctx, 2, map[string]interface{}{"a": "1"}, service.WriteOptions{EffectiveFrom: mar, EffectiveTo: &end})
+	if err != nil {
+		t.Fatalf("UpsertRecord: %v", err)
+	}
+	if _, err := s.GetRecordBitemporal(ctx, 2, end, time.Now()); !errors.Is(err, service.ErrVersionNotFound) {
+		t.Errorf("GetRecordBitemporal at effective_to: got %v, want ErrVersionNotFound", err)
+	}
+}
+
+func testBackdatedWrite(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+	month := func(m time.Month) time.Time { return time.Date(2024, m, 1, 0, 0, 0, 0, time.UTC) }
+
+	write := func(effectiveFrom time.Time, updates map[string]interface{}) entity.Record {
+		t.Helper()
+		record, err := s.UpsertRecord(ctx, 1, updates, service.WriteOptions{EffectiveFrom: effectiveFrom})
+		if err != nil {
+			t.Fatalf("UpsertRecord(%v): %v", effectiveFrom, err)
+		}
+		return record
+	}
+	write(month(time.January), map[string]interface{}{"address": "A", "employees": 10})
+	write(month(time.June), map[string]interface{}{"employees": 20})
+	beforeCorrection := time.Now()
+
+	// The address changed in March, before the change of June that is already
+	// recorded. It applies from March on, and the June change still holds.
+	record := write(month(time.March), map[string]interface{}{"address": "B"})
+	if record.Version != 4 || !record.EffectiveFrom.Equal(month(time.June)) {
+		t.Errorf("back-dated write: got version %d effective from %v, want version 4 effective from June", record.Version, record.EffectiveFrom)
+	}
+
+	now := time.Now()
+	for _, c := range []struct {
+		effectiveAt, knownAt time.Time
+		want                 map[string]interface{}
+	}{
+		{month(time.February), now, map[string]interface{}{"address": "A", "employees": json.Number("10")}},
+		{month(time.April), now, map[string]interface{}{"address": "B", "employees": json.Number("10")}},
+		{month(time.July), now, map[string]interface{}{"address": "B", "employees": json.Number("20")}},
+		{month(time.April), beforeCorrection, map[string]interface{}{"address": "A", "employees": json.Number("10")}},
+	} {
+		record, err := s.GetRecordBitemporal(ctx, 1, c.effectiveAt, c.knownAt)
+		if err != nil {
+			t.Fatalf("GetRecordBitemporal(%v, %v): %v", c.effectiveAt, c.knownAt, err)
+		}
+		assertData(t, record, c.want)
+	}
+
+	versions, err := s.GetRecordHistory(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecordHistory: %v", err)
+	}
+	if march := versions[2]; march.EffectiveTo == nil || !march.EffectiveTo.Equal(month(time.June)) {
+		t.Errorf("back-dated version: got effective_to %v, want June", march.EffectiveTo)
+	}
+
+	// A later delete is not undone by an earlier change.
+	if _, err := s.DeleteRecord(ctx, 1, service.WriteOptions{EffectiveFrom: month(time.September)}); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+	write(month(time.May), map[string]interface{}{"employees": 15})
+	if _, err := s.GetRecordBitemporal(ctx, 1, month(time.October), time.Now()); !errors.Is(err, service.ErrRecordDeleted) {
+		t.Errorf("GetRecordBitemporal after delete: got %v, want ErrRecordDeleted", err)
+	}
+	record, err = s.GetRecordBitemporal(ctx, 1, month(time.July), time.Now())
+	if err != nil {
+		t.Fatalf("GetRecordBitemporal: %v", err)
+	}
+	assertData(t, record, map[string]interface{}{"address": "B", "employees": json.Number("15")})
+}
+
+// testLatestVersionIsCurrent checks that reads of the current record agree
+// with the version in force now after writes that do not reach it.
+func testLatestVersionIsCurrent(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+	month := func(m time.Month) time.Time { return time.Date(2024, m, 1, 0, 0, 0, 0, time.UTC) }
+	march := month(time.March)
+
+	// A change that was only true in February leaves the record as it was.
+	if _, err := s.UpsertRecord(ctx, 1, map[string]interface{}{"a": "1"}, service.WriteOptions{EffectiveFrom: month(time.January)}); err != nil {
+		t.Fatalf("UpsertRecord: %v", err)
+	}
+	record, err := s.UpsertRecord(ctx, 1, map[string]interface{}{"a": "temp"}, service.WriteOptions{EffectiveFrom: month(time.February), EffectiveTo: &march})
+	if err != nil {
+		t.Fatalf("UpsertRecord(February): %v", err)
+	}
+	if record.Version != 3 || !record.EffectiveFrom.Equal(march) || record.EffectiveTo != nil {
+		t.Errorf("bounded write: got version %d effective from %v to %v, want version 3 from March on", record.Version, record.EffectiveFrom, record.EffectiveTo)
+	}
+	assertData(t, record, map[string]interface{}{"a": "1"})
+
+	record, err = s.GetRecord(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecord: %v", err)
+	}
+	assertData(t, record, map[string]interface{}{"a": "1"})
+	page, err := s.ListRecords(ctx, service.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListRecords: %v", err)
+	}
+	if len(page.Records) != 1 || page.Records[0].Data["a"] != "1" {
+		t.Errorf("ListRecords: got %v, want record 1 with a=1", page.Records)
+	}
+	record, err = s.GetRecordBitemporal(ctx, 1, month(time.February), time.Now())
+	if err != nil {
+		t.Fatalf("GetRecordBitemporal(February): %v", err)
+	}
+	assertData(t, record, map[string]interface{}{"a": "temp"})
+
+	// A correction back-dated before a delete does not revive the record.
+	mustUpsert(t, s, 2, map[string]interface{}{"b": "1"})
+	if _, err := s.DeleteRecord(ctx, 2, service.WriteOptions{}); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+	record, err = s.UpsertRecord(ctx, 2, map[string]interface{}{"b": "0"}, service.WriteOptions{EffectiveFrom: month(time.February)})
+	if err != nil {
+		t.Fatalf("UpsertRecord(February): %v", err)
+	}
+	if !record.Deleted {
+		t.Errorf("correction before a delete: got %+v, want a tombstone as the latest version", record)
+	}
+
+	if _, err := s.GetRecord(ctx, 2); !errors.Is(err, service.ErrRecordDeleted) {
+		t.Errorf("GetRecord: got %v, want ErrRecordDeleted", err)
+	}
+	if _, err := s.GetRecordBitemporal(ctx, 2, time.Now(), time.Now()); !errors.Is(err, service.ErrRecordDeleted) {
+		t.Errorf("GetRecordBitemporal(now): got %v, want ErrRecordDeleted", err)
+	}
+	if got, want := snapshot(t, s, time.Now()), []string{"records/1@3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Snapshot: got %v, want %v", got, want)
+	}
+	_, err = s.UpsertRecord(ctx, 2, map[string]interface{}{"b": "2"}, service.WriteOptions{MustExist: true})
+	if !errors.Is(err, service.ErrPreconditionFailed) {
+		t.Errorf("UpsertRecord with MustExist: got %v, want ErrPreconditionFailed", err)
+	}
+	record, err = s.GetRecordBitemporal(ctx, 2, month(time.March), time.Now())
+	if err != nil {
+		t.Fatalf("GetRecordBitemporal(March): %v", err)
+	}
+	assertData(t, record, map[string]interface{}{"b": "0"})
+}
+
+func testInvalidValidity(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	_, err := s.UpsertRecord(ctx, 1, map[string]interface{}{"a": "1"}, service.WriteOptions{EffectiveFrom: from, EffectiveTo: &from})
+	if !errors.Is(err, service.ErrInvalidValidity) {
+		t.Errorf("UpsertRecord: got %v, want ErrInvalidValidity", err)
+	}
+	if _, err := s.GetRecord(ctx, 1); !errors.Is(err, service.ErrRecordDoesNotExist) {
+		t.Errorf("a failed write must not create a version, got %v", err)
+	}
+}
+
+func testUpsert(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	if _, err := s.UpsertRecord(ctx, 0, map[string]interface{}{}, service.WriteOptions{}); !errors.Is(err, service.ErrRecordIDInvalid) {
+		t.Errorf("UpsertRecord(0): got %v, want ErrRecordIDInvalid", err)
+	}
+
+	record := mustUpsert(t, s, 1, map[string]interface{}{"a": "1"})
+	if record.Version != 1 {
+		t.Errorf("first upsert: got version %d, want 1", record.Version)
+	}
+	record = mustUpsert(t, s, 1, map[string]interface{}{"b": "2"})
+	if record.Version != 2 {
+		t.Errorf("second upsert: got version %d, want 2", record.Version)
+	}
+	assertData(t, record, map[string]interface{}{"a": "1", "b": "2"})
+}
+
+func testExpectedVersion(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+	updates := map[string]interface{}{"a": "1"}
+
+	_, err := s.UpsertRecord(ctx, 1, updates, service.WriteOptions{ExpectedVersion: 1})
+	var conflict *service.VersionConflictError
+	if !errors.As(err, &conflict) || conflict.Current != 0 {
+		t.Errorf("UpsertRecord on missing record with expected version: got %v, want a conflict at version 0", err)
+	}
+
+	mustUpsert(t, s, 1, updates)
+	mustUpsert(t, s, 1, updates)
+
+	_, err = s.UpdateRecordWithVersion(ctx, 1, updates, service.WriteOptions{ExpectedVersion: 1})
+	if !errors.Is(err, service.ErrVersionConflict) || !errors.As(err, &conflict) || conflict.Current != 2 {
+		t.Errorf("UpdateRecordWithVersion with stale version: got %v, want a conflict at version 2", err)
+	}
+
+	record, err := s.UpsertRecord(ctx, 1, updates, service.WriteOptions{ExpectedVersion: 2})
+	if err != nil {
+		t.Fatalf("UpsertRecord with current version: %v", err)
+	}
+	if record.Version != 3 {
+		t.Errorf("got version %d, want 3", record.Version)
+	}
+
+	if _, err := s.UpsertRecord(ctx, 2, updates, service.WriteOptions{MustExist: true}); !errors.Is(err, service.ErrPreconditionFailed) {
+		t.Errorf("UpsertRecord on missing record that must exist: got %v, want ErrPreconditionFailed", err)
+	}
+	if _, err := s.GetRecord(ctx, 2); !errors.Is(err, service.ErrRecordDoesNotExist) {
+		t.Errorf("a failed precondition must not create the record, got %v", err)
+	}
+	if record, err := s.UpsertRecord(ctx, 1, updates, service.WriteOptions{MustExist: true}); err != nil || record.Version != 4 {
+		t.Errorf("UpsertRecord on existing record that must exist: got version %d, %v, want version 4", record.Version, err)
+	}
+	if _, err := s.DeleteRecord(ctx, 1, service.WriteOptions{}); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+	if _, err := s.UpsertRecord(ctx, 1, updates, service.WriteOptions{MustExist: true}); !errors.Is(err, service.ErrPreconditionFailed) {
+		t.Errorf("UpsertRecord on deleted record that must exist: got %v, want ErrPreconditionFailed", err)
+	}
+}
+
+func testDeleteAndRestore(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	if _, err := s.DeleteRecord(ctx, 1, service.WriteOptions{}); !errors.Is(err, service.ErrRecordDoesNotExist) {
+		t.Errorf("DeleteRecord on missing record: got %v, want ErrRecordDoesNotExist", err)
+	}
+
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "1"})
+	tombstone, err := s.DeleteRecord(ctx, 1, service.WriteOptions{})
+	if err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+	if tombstone.Version != 2 || !tombstone.Deleted {
+		t.Errorf("DeleteRecord: got %+v, want a tombstone at version 2", tombstone)
+	}
+
+	if _, err := s.GetRecord(ctx, 1); !errors.Is(err, service.ErrRecordDeleted) || !errors.Is(err, service.ErrRecordDoesNotExist) {
+		t.Errorf("GetRecord after delete: got %v, want ErrRecordDeleted", err)
+	}
+	if _, err := s.GetRecordAsOf(ctx, 1, time.Now()); !errors.Is(err, service.ErrRecordDeleted) {
+		t.Errorf("GetRecordAsOf after delete: got %v, want ErrRecordDeleted", err)
+	}
+	if _, err := s.GetRecordAsOf(ctx, 1, tombstone.RecordedAt.Add(-time.Nanosecond)); err != nil {
+		t.Errorf("GetRecordAsOf before delete: %v", err)
+	}
+	if _, err := s.DeleteRecord(ctx, 1, service.WriteOptions{}); !errors.Is(err, service.ErrRecordDeleted) {
+		t.Errorf("DeleteRecord twice: got %v, want ErrRecordDeleted", err)
+	}
+
+	record, err := s.GetRecordVersion(ctx, 1, 1)
+	if err != nil {
+		t.Fatalf("GetRecordVersion of a deleted record: %v", err)
+	}
+	assertData(t, record, map[string]interface{}{"a": "1"})
+
+	versions, err := s.GetRecordVersions(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecordVersions of a deleted record: %v", err)
+	}
+	if len(versions) != 2 || !versions[1].Deleted {
+		t.Fatalf("GetRecordVersions: got %+v, want the tombstone last", versions)
+	}
+	if tombstone := versions[1]; !reflect.DeepEqual(tombstone.KeysTouched, []string{"a"}) || tombstone.Summary != "deleted" {
+		t.Errorf("tombstone descriptor: got keys %v and summary %q, want [a] and deleted", tombstone.KeysTouched, tombstone.Summary)
+	}
+
+	restored, err := s.RestoreRecord(ctx, 1, service.WriteOptions{})
+	if err != nil {
+		t.Fatalf("RestoreRecord: %v", err)
+	}
+	if restored.Version != 3 || restored.Deleted {
+		t.Errorf("RestoreRecord: got %+v, want a live record at version 3", restored)
+	}
+	assertData(t, restored, map[string]interface{}{"a": "1"})
+
+	versions, err = s.GetRecordVersions(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecordVersions: %v", err)
+	}
+	if restore := versions[2]; !reflect.DeepEqual(restore.KeysTouched, []string{"a"}) || restore.Summary != "restored" {
+		t.Errorf("restore descriptor: got keys %v and summary %q, want [a] and restored", restore.KeysTouched, restore.Summary)
+	}
+
+	if _, err := s.RestoreRecord(ctx, 1, service.WriteOptions{}); !errors.Is(err, service.ErrRecordNotDeleted) {
+		t.Errorf("RestoreRecord on live record: got %v, want ErrRecordNotDeleted", err)
+	}
+	if _, err := s.RestoreRecord(ctx, 2, service.WriteOptions{}); !errors.Is(err, service.ErrRecordDoesNotExist) {
+		t.Errorf("RestoreRecord on missing record: got %v, want ErrRecordDoesNotExist", err)
+	}
+}
+
+func testWriteAfterDelete(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "1"})
+	if _, err := s.DeleteRecord(ctx, 1, service.WriteOptions{}); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+
+	_, err := s.UpdateRecordWithVersion(ctx, 1, map[string]interface{}{"b": "2"}, service.WriteOptions{})
+	if !errors.Is(err, service.ErrRecordDeleted) {
+		t.Errorf("UpdateRecordWithVersion on deleted record: got %v, want ErrRecordDeleted", err)
+	}
+
+	// Upserting starts the record over, continuing its version numbers.
+	record := mustUpsert(t, s, 1, map[string]interface{}{"b": "2"})
+	if record.Version != 3 {
+		t.Errorf("UpsertRecord after delete: got version %d, want 3", record.Version)
+	}
+	assertData(t, record, map[string]interface{}{"b": "2"})
+}
+
+func testRevert(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "1"})
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "2", "b": "2"})
+
+	record, err := s.RevertRecord(ctx, 1, 1, service.WriteOptions{})
+	if err != nil {
+		t.Fatalf("RevertRecord: %v", err)
+	}
+	if record.Version != 3 {
+		t.Errorf("RevertRecord: got version %d, want 3", record.Version)
+	}
+	assertData(t, record, map[string]interface{}{"a": "1"})
+
+	// History is appended to, not rewritten.
+	record, err = s.GetRecordVersion(ctx, 1, 2)
+	if err != nil {
+		t.Fatalf("GetRecordVersion: %v", err)
+	}
+	assertData(t, record, map[string]interface{}{"a": "2", "b": "2"})
+
+	if _, err := s.RevertRecord(ctx, 1, 9, service.WriteOptions{}); !errors.Is(err, service.ErrVersionNotFound) {
+		t.Errorf("RevertRecord to missing version: got %v, want ErrVersionNotFound", err)
+	}
+	_, err = s.RevertRecord(ctx, 1, 1, service.WriteOptions{ExpectedVersion: 2})
+	if !errors.Is(err, service.ErrVersionConflict) {
+		t.Errorf("RevertRecord with stale version: got %v, want ErrVersionConflict", err)
+	}
+
+	if _, err := s.DeleteRecord(ctx, 1, service.WriteOptions{}); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+	if _, err := s.RevertRecord(ctx, 1, 4, service.WriteOptions{}); !errors.Is(err, service.ErrRevertToTombstone) {
+		t.Errorf("RevertRecord to tombstone: got %v, want ErrRevertToTombstone", err)
+	}
+	record, err = s.RevertRecord(ctx, 1, 2, service.WriteOptions{})
+	if err != nil {
+		t.Fatalf("RevertRecord on deleted record: %v", err)
+	}
+	if record.Deleted {
+		t.Errorf("RevertRecord on deleted record: expected the record to be revived")
+	}
+}
+
+func testAuthorAndReason(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	_, err := s.UpsertRecord(ctx, 1, map[string]interface{}{"a": "1"}, service.WriteOptions{Author: "alice", Reason: "onboarding"})
+	if err != nil {
+		t.Fatalf("UpsertRecord: %v", err)
+	}
+	// Metadata belongs to a single version and is not carried forward.
+	mustUpsert(t, s, 1, map[string]interface{}{"a": "2"})
+
+	record, err := s.GetRecordVersion(ctx, 1, 1)
+	if err != nil {
+		t.Fatalf("GetRecordVersion: %v", err)
+	}
+	if record.Author != "alice" || record.Reason != "onboarding" {
+		t.Errorf("version 1: got author %q reason %q", record.Author, record.Reason)
+	}
+
+	versions, err := s.GetRecordVersions(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecordVersions: %v", err)
+	}
+	if versions[0].Author != "alice" || versions[0].Reason != "onboarding" || versions[1].Author != "" {
+		t.Errorf("GetRecordVersions: got %+v", versions)
+	}
+}
+
+// listIDs walks every page of a listing and returns the ids in order.
+func testTypedValues(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	mustUpsert(t, s, 1, map[string]interface{}{
+		"employees": 12,
+		"premium":   json.Number("12345678901234567890.50"),
+		"active":    true,
+		"address":   map[string]interface{}{"city": "Oakland", "zip": "94607"},
+		"tags":      []interface{}{"retail", 3, nil},
+	})
+	record, err := s.UpdateRecord(ctx, 1, map[string]interface{}{"active": false, "tags": nil})
+	if err != nil {
+		t.Fatalf("UpdateRecord: %v", err)
+	}
+
+	want := map[string]interface{}{
+		"employees": json.Number("12"),
+		"premium":   json.Number("12345678901234567890.50"),
+		"active":    false,
+		"address":   map[string]interface{}{"city": "Oakland", "zip": "94607"},
+	}
+	assertData(t, record, want)
+
+	record, err = s.GetRecord(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecord: %v", err)
+	}
+	assertData(t, record, want)
+
+	first, err := s.GetRecordVersion(ctx, 1, 1)
+	if err != nil {
+		t.Fatalf("GetRecordVersion: %v", err)
+	}
+	if tags := first.Data["tags"]; !reflect.DeepEqual(tags, []interface{}{"retail", json.Number("3"), nil}) {
+		t.Errorf("version 1: got tags %#v", tags)
+	}
+
+	filter, _ := service.ParseFilter("employees:gt:9")
+	if ids := listIDs(t, s, service.ListOptions{Filters: []service.Filter{filter}}); !reflect.DeepEqual(ids, []int{1}) {
+		t.Errorf("ListRecords with employees:gt:9: got ids %v, want [1]", ids)
+	}
+
+	_, err = s.UpsertRecord(ctx, 1, map[string]interface{}{"bad": func() {}}, service.WriteOptions{})
+	if !errors.Is(err, service.ErrInvalidValue) {
+		t.Errorf("UpsertRecord with a function: got %v, want ErrInvalidValue", err)
+	}
+}
+
+func testMergePatch(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	record, err := s.PatchRecord(ctx, 1, service.MergePatch{
+		"name":    "Acme",
+		"address": map[string]interface{}{"street": "1 Old Road", "city": "Oakland", "geo": map[string]interface{}{"lat": 37.8}},
+		"unset":   nil,
+	}, service.WriteOptions{})
+	if err != nil {
+		t.Fatalf("PatchRecord: %v", err)
+	}
+	if record.Version != 1 {
+		t.Errorf("PatchRecord on a new record: got version %d, want 1", record.Version)
+	}
+
+	record, err = s.PatchRecord(ctx, 1, service.MergePatch{
+		"address": map[string]interface{}{"street": "2 New Street", "geo": nil, "unit": map[string]interface{}{"floor": nil}},
+		"tags":    []interface{}{"a"},
+	}, service.WriteOptions{})
+	if err != nil {
+		t.Fatalf("PatchRecord: %v", err)
+	}
+	if record.Version != 2 {
+		t.Errorf("PatchRecord: got version %d, want 2", record.Version)
+	}
+	want := map[string]interface{}{
+		"name":    "Acme",
+		"address": map[string]interface{}{"street": "2 New Street", "city": "Oakland", "unit": map[string]interface{}{}},
+		"tags":    []interface{}{"a"},
+	}
+	assertData(t, record, want)
+
+	// The patched version was copied, not shared with the previous one.
+	first, err := s.GetRecordVersion(ctx, 1, 1)
+	if err != nil {
+		t.Fatalf("GetRecordVersion: %v", err)
+	}
+	if address := first.Data["address"].(map[string]interface{}); address["street"] != "1 Old Road" || address["geo"] == nil {
+		t.Errorf("version 1 was modified: got address %v", address)
+	}
+
+	record, err = s.PatchRecord(ctx, 1, service.MergePatch{"address": "unknown", "tags": nil}, service.WriteOptions{ExpectedVersion: 2})
+	if err != nil {
+		t.Fatalf("PatchRecord: %v", err)
+	}
+	assertData(t, record, map[string]interface{}{"name": "Acme", "address": "unknown"})
+
+	_, err = s.PatchRecord(ctx, 1, service.MergePatch{"name": "Stale"}, service.WriteOptions{ExpectedVersion: 2})
+	if !errors.Is(err, service.ErrVersionConflict) {
+		t.Errorf("PatchRecord with a stale version: got %v, want ErrVersionConflict", err)
+	}
+
+	// Each patch appends exactly one version, so patches that would be
+	// carried over a later change, or end before it, are refused.
+	countVersions := func() int {
+		t.Helper()
+		history, err := s.GetRecordHistory(ctx, 1)
+		if err != nil {
+			t.Fatalf("GetRecordHistory: %v", err)
+		}
+		return len(history)
+	}
+	nextMonth := time.Now().AddDate(0, 1, 0)
+	if _, err := s.PatchRecord(ctx, 1, service.MergePatch{"name": "Acme Corp"}, service.WriteOptions{EffectiveFrom: nextMonth}); err != nil {
+		t.Fatalf("PatchRecord(next month): %v", err)
+	}
+	if got := countVersions(); got != 4 {
+		t.Errorf("after a future-dated patch: got %d versions, want 4", got)
+	}
+	_, err = s.PatchRecord(ctx, 1, service.MergePatch{"address": "known"}, service.WriteOptions{})
+	if !errors.Is(err, service.ErrPatchSpansChanges) {
+		t.Errorf("PatchRecord before a future change: got %v, want ErrPatchSpansChanges", err)
+	}
+	end := nextMonth.AddDate(0, 2, 0)
+	_, err = s.PatchRecord(ctx, 1, service.MergePatch{"address": "known"}, service.WriteOptions{EffectiveFrom: nextMonth.AddDate(0, 1, 0), EffectiveTo: &end})
+	if !errors.Is(err, service.ErrPatchSpansChanges) {
+		t.Errorf("PatchRecord with an end: got %v, want ErrPatchSpansChanges", err)
+	}
+	if got := countVersions(); got != 4 {
+		t.Errorf("after refused patches: got %d versions, want 4", got)
+	}
+	record, err = s.PatchRecord(ctx, 1, service.MergePatch{"address": "known"}, service.WriteOptions{EffectiveFrom: nextMonth.AddDate(0, 1, 0)})
+	if err != nil {
+		t.Fatalf("PatchRecord(after the future change): %v", err)
+	}
+	if got := countVersions(); got != 5 || record.Version != 5 {
+		t.Errorf("after a patch: got %d versions and version %d, want 5", got, record.Version)
+	}
+	assertData(t, record, map[string]interface{}{"name": "Acme Corp", "address": "known"})
+}
+
+func testJSONPatch(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	mustUpsert(t, s, 1, map[string]interface{}{
+		"name":      "Acme",
+		"employees": 12,
+		"a/b":       "slash",
+		"address":   map[string]interface{}{"city": "Oakland"},
+		"tags":      []interface{}{"retail", "ca"},
+	})
+
+	patch, err := service.ParseJSONPatch([]byte(`[
+		{"op": "test", "path": "/employees", "value": 12.0},
+		{"op": "replace", "path": "/employees", "value": 13},
+		{"op": "add", "path": "/tags/1", "value": "bakery"},
+		{"op": "add", "path": "/tags/-", "value": "new"},
+		{"op": "remove", "path": "/tags/0"},
+		{"op": "move", "from": "/a~1b", "path": "/address/note"},
+		{"op": "copy", "from": "/address/city", "path": "/city"},
+		{"op": "add", "path": "/address/zip", "value": "94607"},
+		{"op": "test", "path": "/address", "value": {"city": "Oakland", "note": "slash", "zip": "94607"}}
+	]`))
+	if err != nil {
+		t.Fatalf("ParseJSONPatch: %v", err)
+	}
+	record, err := s.PatchRecord(ctx, 1, patch, service.WriteOptions{})
+	if err != nil {
+		t.Fatalf("PatchRecord: %v", err)
+	}
+	if record.Version != 2 {
+		t.Errorf("PatchRecord: got version %d, want 2", record.Version)
+	}
+	want := map[string]interface{}{
+		"name":      "Acme",
+		"employees": json.Number("13"),
+		"address":   map[string]interface{}{"city": "Oakland", "note": "slash", "zip": "94607"},
+		"tags":      []interface{}{"bakery", "ca", "new"},
+		"city":      "Oakland",
+	}
+	assertData(t, record, want)
+
+	// A failed operation fails the whole patch, and no version is written.
+	for _, c := range []struct {
+		patch string
+		want  error
+	}{
+		{`[{"op": "replace", "path": "/name", "value": "Other"}, {"op": "test", "path": "/employees", "value": 12}]`, service.ErrPatchTestFailed},
+		{`[{"op": "remove", "path": "/name"}, {"op": "test", "path": "/missing", "value": 1}]`, service.ErrPatchTestFailed},
+		{`[{"op": "remove", "path": "/name"}, {"op": "remove", "path": "/missing"}]`, service.ErrInvalidPatch},
+		{`[{"op": "add", "path": "/tags/9", "value": "x"}]`, service.ErrInvalidPatch},
+		{`[{"op": "replace", "path": "", "value": [1]}]`, service.ErrInvalidPatch},
+		{`[{"op": "move", "from": "/address", "path": "/address/inner"}]`, service.ErrInvalidPatch},
+	} {
+		patch, err := service.ParseJSONPatch([]byte(c.patch))
+		if err != nil {
+			t.Fatalf("ParseJSONPatch(%s): %v", c.patch, err)
+		}
+		if _, err := s.PatchRecord(ctx, 1, patch, service.WriteOptions{}); !errors.Is(err, c.want) {
+			t.Errorf("PatchRecord(%s): got %v, want %v", c.patch, err, c.want)
+		}
+	}
+
+	record, err = s.GetRecord(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecord: %v", err)
+	}
+	if record.Version != 2 {
+		t.Errorf("failed patches wrote versions: got version %d, want 2", record.Version)
+	}
+	assertData(t, record, want)
+
+	for _, invalid := range []string{`{}`, `[{"op": "add", "path": "/x"}]`, `[{"op": "frobnicate", "path": "/x"}]`, `[{"op": "copy", "path": "/x"}]`, `[{"op": "remove"}]`} {
+		if _, err := service.ParseJSONPatch([]byte(invalid)); !errors.Is(err, service.ErrInvalidPatch) {
+			t.Errorf("ParseJSONPatch(%s): got %v, want ErrInvalidPatch", invalid, err)
+		}
+	}
+}
+
+func testCollections(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	policies, err := s.Collection("policies")
+	if err != nil {
+		t.Fatalf("Collection: %v", err)
+	}
+
+	mustUpsert(t, s, 1, map[string]interface{}{"name": "Acme"})
+	mustUpsert(t, s, 1, map[string]interface{}{"name": "Acme Inc"})
+	record := mustUpsert(t, policies, 1, map[string]interface{}{"policy": "GL-1"})
+	if record.Version != 1 || record.Collection != "policies" {
+		t.Errorf("policies/1: got version %d in %q, want version 1 in policies", record.Version, record.Collection)
+	}
+
+	record, err = s.GetRecord(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecord: %v", err)
+	}
+	if record.Collection != service.DefaultCollection {
+		t.Errorf("GetRecord: got collection %q, want %q", record.Collection, service.DefaultCollection)
+	}
+	assertData(t, record, map[string]interface{}{"name": "Acme Inc"})
+
+	record, err = policies.GetRecord(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecord from policies: %v", err)
+	}
+	assertData(t, record, map[string]interface{}{"policy": "GL-1"})
+
+	if _, err := policies.GetRecordVersion(ctx, 1, 2); !errors.Is(err, service.ErrVersionNotFound) {
+		t.Errorf("GetRecordVersion(policies/1, 2): got %v, want ErrVersionNotFound", err)
+	}
+	if ids := listIDs(t, policies, service.ListOptions{}); !reflect.DeepEqual(ids, []int{1}) {
+		t.Errorf("ListRecords(policies): got ids %v, want [1]", ids)
+	}
+	if results, err := policies.SearchRecords(ctx, service.SearchOptions{Query: "acme"}); err != nil || len(results) != 0 {
+		t.Errorf("SearchRecords(policies): got %v, %v, want no results", results, err)
+	}
+
+	// Collections are the same whichever collection they are reached from.
+	again, err := policies.Collection(service.DefaultCollection)
+	if err != nil {
+		t.Fatalf("Collection: %v", err)
+	}
+	if record, err := again.GetRecord(ctx, 1); err != nil || record.Version != 2 {
+		t.Errorf("GetRecord(records/1): got version %d, %v, want version 2", record.Version, err)
+	}
+
+	if err := s.CreateCollection(ctx, "locations"); err != nil {
+		t.Fatalf("CreateCollection: %v", err)
+	}
+	names, err := s.ListCollections(ctx)
+	if err != nil {
+		t.Fatalf("ListCollections: %v", err)
+	}
+	if want := []string{"locations", "policies", "records"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ListCollections: got %v, want %v", names, want)
+	}
+
+	for _, name := range []string{"", "Policies", "1st", "a/b"} {
+		if _, err := s.Collection(name); !errors.Is(err, service.ErrCollectionNameInvalid) {
+			t.Errorf("Collection(%q): got %v, want ErrCollectionNameInvalid", name, err)
+		}
+	}
+}
+
+func listIDs(t *testing.T, s service.RecordService, opts service.ListOptions) []int {
+	t.Helper()
+	ids := []int{}
+	for {
+		page, err := s.ListRecords(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("ListRecords(%+v): %v", opts, err)
+		}
+		if opts.Limit > 0 && len(page.Records) > opts.Limit {
+			t.Fatalf("ListRecords: got %d records, want at most %d", len(page.Records), opts.Limit)
+		}
+		for _, record := range page.Records {
+			ids = append(ids, record.ID)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+func testSchema(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	if _, err := s.GetSchema(ctx, 0); !errors.Is(err, service.ErrSchemaNotFound) {
+		t.Errorf("GetSchema without a schema: got %v, want ErrSchemaNotFound", err)
+	}
+
+	// Records written before there is a schema are not validated.
+	record := mustUpsert(t, s, 1, map[string]interface{}{"name": 7})
+	if record.SchemaVersion != 0 {
+		t.Errorf("record without schema: got schema version %d, want 0", record.SchemaVersion)
+	}
+
+	schema, err := s.SetSchema(ctx, []byte(`{"type": "object", "required": ["name"]}`))
+	if err != nil {
+		t.Fatalf("SetSchema: %v", err)
+	}
+	if schema.Version != 1 || schema.Collection != service.DefaultCollection {
+		t.Errorf("SetSchema: got version %d in %q, want version 1 in records", schema.Version, schema.Collection)
+	}
+
+	schema, err = s.SetSchema(ctx, []byte(`{
+		"type": "object",
+		"required": ["name"],
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"premium": {"type": "number", "minimum": 0},
+			"tags": {"type": "array", "items": {"enum": ["gl", "auto"]}}
+		},
+		"additionalProperties": false
+	}`))
+	if err != nil {
+		t.Fatalf("SetSchema: %v", err)
+	}
+	if schema.Version != 2 {
+		t.Errorf("SetSchema: got version %d, want 2", schema.Version)
+	}
+
+	if latest, err := s.GetSchema(ctx, 0); err != nil || latest.Version != 2 {
+		t.Errorf("GetSchema(latest): got version %d, %v, want version 2", latest.Version, err)
+	}
+	first, err := s.GetSchema(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetSchema(1): %v", err)
+	}
+	if string(first.Schema) != `{"type": "object", "required": ["name"]}` {
+		t.Errorf("GetSchema(1): got %s", first.Schema)
+	}
+	if _, err := s.GetSchema(ctx, 3); !errors.Is(err, service.ErrSchemaNotFound) {
+		t.Errorf("GetSchema(3): got %v, want ErrSchemaNotFound", err)
+	}
+
+	record = mustUpsert(t, s, 2, map[string]interface{}{"name": "Acme", "premium": 12.5, "tags": []interface{}{"gl"}})
+	if record.SchemaVersion != 2 {
+		t.Errorf("valid record: got schema version %d, want 2", record.SchemaVersion)
+	}
+	versions, err := s.GetRecordVersions(ctx, 2)
+	if err != nil {
+		t.Fatalf("GetRecordVersions: %v", err)
+	}
+	if len(versions) != 1 || versions[0].SchemaVersion != 2 {
+		t.Errorf("GetRecordVersions: got %+v, want one version validated with schema 2", versions)
+	}
+
+	_, err = s.UpsertRecord(ctx, 2, map[string]interface{}{"name": "", "premium": -1, "tags": []interface{}{"home"}, "extra": true}, service.WriteOptions{})
+	var invalid *service.SchemaValidationError
+	if !errors.As(err, &invalid) || !errors.Is(err, service.ErrSchemaValidation) {
+		t.Fatalf("invalid update: got %v, want a SchemaValidationError", err)
+	}
+	var paths []string
+	for _, fieldError := range invalid.Errors {
+		paths = append(paths, fieldError.Path)
+	}
+	if want := []string{"/extra", "/name", "/premium", "/tags/0"}; invalid.SchemaVersion != 2 || !reflect.DeepEqual(paths, want) {
+		t.Errorf("invalid update: got errors %+v with schema version %d, want paths %v with schema version 2", invalid.Errors, invalid.SchemaVersion, want)
+	}
+	if record, err := s.GetRecord(ctx, 2); err != nil || record.Version != 1 {
+		t.Errorf("GetRecord after invalid update: got version %d, %v, want version 1", record.Version, err)
+	}
+
+	// Existing records must satisfy the new schema on their next write.
+	if _, err := s.UpsertRecord(ctx, 1, map[string]interface{}{"premium": 3}, service.WriteOptions{}); !errors.Is(err, service.ErrSchemaValidation) {
+		t.Errorf("update of record written without schema: got %v, want ErrSchemaValidation", err)
+	}
+
+	// Tombstones carry no data to validate.
+	if _, err := s.DeleteRecord(ctx, 1, service.WriteOptions{}); err != nil {
+		t.Errorf("DeleteRecord: %v", err)
+	}
+
+	for _, raw := range []string{`[]`, `{"type": "objekt"}`, `{"$ref": "#/definitions/x"}`, `{"properties": {"a": {"minimum": "1"}}}`, `{`} {
+		if _, err := s.SetSchema(ctx, []byte(raw)); !errors.Is(err, service.ErrInvalidSchema) {
+			t.Errorf("SetSchema(%s): got %v, want ErrInvalidSchema", raw, err)
+		}
+	}
+
+	// Schemas belong to a single collection.
+	policies, err := s.Collection("policies")
+	if err != nil {
+		t.Fatalf("Collection: %v", err)
+	}
+	if record := mustUpsert(t, policies, 1, map[string]interface{}{"policy": "GL-1"}); record.SchemaVersion != 0 {
+		t.Errorf("policies/1: got schema version %d, want 0", record.SchemaVersion)
+	}
+}
+
+func testReferences(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	locations, err := s.Collection("locations")
+	if err != nil {
+		t.Fatalf("Collection: %v", err)
+	}
+	employees, err := s.Collection("employees")
+	if err != nil {
+		t.Fatalf("Collection: %v", err)
+	}
+	policies, err := s.Collection("policies")
+	if err != nil {
+		t.Fatalf("Collection: %v", err)
+	}
+
+	mustUpsert(t, locations, 1, map[string]interface{}{"city": "Austin"})
+	mustUpsert(t, employees, 1, map[string]interface{}{"name": "Ada"})
+	policy := mustUpsert(t, policies, 1, map[string]interface{}{
+		"location": entity.Reference{Collection: "locations", ID: 1}.Value(),
+		"insureds": []interface{}{
+			entity.Reference{Collection: "employees", ID: 1}.Value(),
+			entity.Reference{Collection: "employees", ID: 2}.Value(),
+		},
+		"number": "GL-1",
+	})
+	mustUpsert(t, locations, 1, map[string]interface{}{"city": "Dallas"})
+	if _, err := employees.DeleteRecord(ctx, 1, service.WriteOptions{}); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+
+	keys := []string{"location", "insureds", "missing"}
+	for _, c := range []struct {
+		name    string
+		opts    service.ExpandOptions
+		city    string
+		insured bool
+	}{
+		{"latest", service.ExpandOptions{Keys: keys}, "Dallas", false},
+		{"as of", service.ExpandOptions{Keys: keys, AsOf: policy.RecordedAt}, "Austin", true},
+		{"bitemporal", service.ExpandOptions{Keys: keys, EffectiveAt: time.Now(), KnownAt: policy.RecordedAt}, "Austin", true},
+	} {
+		expanded, err := service.ExpandReferences(ctx, s, policy.Data, c.opts)
+		if err != nil {
+			t.Fatalf("ExpandReferences(%s): %v", c.name, err)
+		}
+		if _, ok := expanded["missing"]; ok || len(expanded) != 2 {
+			t.Errorf("ExpandReferences(%s): got keys %v, want location and insureds", c.name, expanded)
+		}
+
+		location, ok := expanded["location"].(*entity.Record)
+		if !ok || location == nil || location.Collection != "locations" || location.Data["city"] != c.city {
+			t.Errorf("ExpandReferences(%s): got location %+v, want %s", c.name, expanded["location"], c.city)
+		}
+
+		// employees/1 is deleted and employees/2 was never created.
+		insureds, ok := expanded["insureds"].([]*entity.Record)
+		if !ok || len(insureds) != 2 || insureds[1] != nil {
+			t.Fatalf("ExpandReferences(%s): got insureds %+v, want two", c.name, expanded["insureds"])
+		}
+		if found := insureds[0] != nil; found != c.insured {
+			t.Errorf("ExpandReferences(%s): got insured %+v, want found %v", c.name, insureds[0], c.insured)
+		}
+	}
+
+	if _, err := service.ExpandReferences(ctx, s, policy.Data, service.ExpandOptions{Keys: []string{"number"}}); !errors.Is(err, service.ErrNotAReference) {
+		t.Errorf("ExpandReferences(number): got %v, want ErrNotAReference", err)
+	}
+
+	for _, value := range []interface{}{
+		map[string]interface{}{"$ref": "Locations/1"},
+		map[string]interface{}{"$ref": "locations/0"},
+		map[string]interface{}{"$ref": "locations"},
+		map[string]interface{}{"$ref": 3},
+		map[string]interface{}{"$ref": "locations/1", "city": "Austin"},
+		[]interface{}{map[string]interface{}{"nested": map[string]interface{}{"$ref": "locations/x"}}},
+	} {
+		_, err := policies.UpsertRecord(ctx, 2, map[string]interface{}{"location": value}, service.WriteOptions{})
+		if !errors.Is(err, service.ErrInvalidReference) {
+			t.Errorf("UpsertRecord(%v): got %v, want ErrInvalidReference", value, err)
+		}
+	}
+}
+
+func testListRecords(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	if ids := listIDs(t, s, service.ListOptions{}); len(ids) != 0 {
+		t.Errorf("ListRecords on empty service: got %v", ids)
+	}
+
+	for _, id := range []int{3, 1, 4, 2} {
+		mustUpsert(t, s, id, map[string]interface{}{"a": "1"})
+	}
+	if _, err := s.DeleteRecord(ctx, 4, service.WriteOptions{}); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+	since := time.Now()
+	mustUpsert(t, s, 3, map[string]interface{}{"a": "2"})
+
+	for _, c := range []struct {
+		name string
+		opts service.ListOptions
+		want []int
+	}{
+		{"by id", service.ListOptions{Limit: 2}, []int{1, 2, 3}},
+		{"by id descending", service.ListOptions{Limit: 2, Descending: true}, []int{3, 2, 1}},
+		{"by updated_at", service.ListOptions{Limit: 1, SortBy: service.SortByUpdatedAt}, []int{1, 2, 3}},
+		{"by updated_at descending", service.ListOptions{SortBy: service.SortByUpdatedAt, Descending: true}, []int{3, 2, 1}},
+		{"updated since", service.ListOptions{UpdatedSince: since}, []int{3}},
+	} {
+		if ids := listIDs(t, s, c.opts); !reflect.DeepEqual(ids, c.want) {
+			t.Errorf("%s: got ids %v, want %v", c.name, ids, c.want)
+		}
+	}
+
+	page, err := s.ListRecords(ctx, service.ListOptions{Limit: 1})
+	if err != nil {
+		t.Fatalf("ListRecords: %v", err)
+	}
+	if len(page.Records) != 1 || page.Records[0].Version != 1 || page.NextCursor == "" {
+		t.Errorf("ListRecords: got %+v, want record 1 and a cursor", page)
+	}
+}
+
+func testListRecordsErrors(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	if _, err := s.ListRecords(ctx, service.ListOptions{SortBy: "name"}); !errors.Is(err, service.ErrInvalidSort) {
+		t.Errorf("ListRecords with unknown sort: got %v, want ErrInvalidSort", err)
+	}
+	if _, err := s.ListRecords(ctx, service.ListOptions{Cursor: "not a cursor"}); !errors.Is(err, service.ErrInvalidCursor) {
+		t.Errorf("ListRecords with bad cursor: got %v, want ErrInvalidCursor", err)
+	}
+}
+
+func testListRecordsFilters(t *testing.T, s service.RecordService) {
+	mustUpsert(t, s, 1, map[string]interface{}{"state": "CA", "employees": "120"})
+	mustUpsert(t, s, 2, map[string]interface{}{"state": "CA", "employees": "9"})
+	mustUpsert(t, s, 3, map[string]interface{}{"state": "NY", "employees": "60"})
+	mustUpsert(t, s, 4, map[string]interface{}{"state": "CA"})
+
+	for _, c := range []struct {
+		where []string
+		want  []int
+	}{
+		{[]string{"state:eq:CA"}, []int{1, 2, 4}},
+		{[]string{"state:eq:CA", "employees:gt:50"}, []int{1}},
+		{[]string{"employees:lte:60"}, []int{2, 3}},
+		{[]string{"employees:exists"}, []int{1, 2, 3}},
+		{[]string{"state:ne:CA"}, []int{3}},
+		{[]string{"employees:ne:9"}, []int{1, 3, 4}},
+		{[]string{"state:contains:Y"}, []int{3}},
+	} {
+		var filters []service.Filter
+		for _, where := range c.where {
+			filter, err := service.ParseFilter(where)
+			if err != nil {
+				t.Fatalf("ParseFilter(%q): %v", where, err)
+			}
+			filters = append(filters, filter)
+		}
+
+		// A small page size makes the filters span several pages.
+		ids := listIDs(t, s, service.ListOptions{Filters: filters, Limit: 1})
+		if !reflect.DeepEqual(ids, c.want) {
+			t.Errorf("%v: got ids %v, want %v", c.where, ids, c.want)
+		}
+	}
+
+	for _, where := range []string{"state", "state:like:CA", ":eq:CA"} {
+		if _, err := service.ParseFilter(where); err == nil {
+			t.Errorf("ParseFilter(%q): expected an error", where)
+		}
+	}
+}
+
+func testListRecordsAsOf(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+	jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	jun := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	for id, state := range map[int]string{1: "CA", 2: "NY"} {
+		_, err := s.UpsertRecord(ctx, id, map[string]interface{}{"state": state}, service.WriteOptions{EffectiveFrom: jan})
+		if err != nil {
+			t.Fatalf("UpsertRecord: %v", err)
+		}
+	}
+	before := time.Now()
+	_, err := s.UpsertRecord(ctx, 2, map[string]interface{}{"state": "CA"}, service.WriteOptions{EffectiveFrom: jun})
+	if err != nil {
+		t.Fatalf("UpsertRecord: %v", err)
+	}
+	mustUpsert(t, s, 3, map[string]interface{}{"state": "CA"})
+
+	filter, _ := service.ParseFilter("state:eq:CA")
+	filters := []service.Filter{filter}
+
+	for _, c := range []struct {
+		name string
+		opts service.ListOptions
+		want []int
+	}{
+		{"latest", service.ListOptions{Filters: filters}, []int{1, 2, 3}},
+		{"as of", service.ListOptions{Filters: filters, AsOf: before}, []int{1}},
+		{"effective at", service.ListOptions{Filters: filters, EffectiveAt: jun.AddDate(0, -1, 0)}, []int{1}},
+		{"effective later", service.ListOptions{Filters: filters, EffectiveAt: jun}, []int{1, 2}},
+	} {
+		if ids := listIDs(t, s, c.opts); !reflect.DeepEqual(ids, c.want) {
+			t.Errorf("%s: got ids %v, want %v", c.name, ids, c.want)
+		}
+	}
+}
+
+// testIndexes checks that filtering on indexed keys gives the same results as
+// a scan. It is skipped for services that do not implement service.Indexer.
+func testIndexes(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+	indexer, ok := s.(service.Indexer)
+	if !ok {
+		t.Skip("service does not implement service.Indexer")
+	}
+
+	mustUpsert(t, s, 1, map[string]interface{}{"state": "CA", "employees": "120"})
+	mustUpsert(t, s, 2, map[string]interface{}{"state": "CA", "employees": "9"})
+	if err := indexer.IndexKey(ctx, "employees"); err != nil {
+		t.Fatalf("IndexKey: %v", err)
+	}
+	if err := indexer.IndexKey(ctx, "employees"); err != nil {
+		t.Fatalf("IndexKey again: %v", err)
+	}
+	if err := indexer.IndexKey(ctx, ""); !errors.Is(err, service.ErrInvalidIndexKey) {
+		t.Errorf("IndexKey(\"\"): got %v, want ErrInvalidIndexKey", err)
+	}
+
+	before := time.Now()
+	mustUpsert(t, s, 2, map[string]interface{}{"employees": "90"})
+	mustUpsert(t, s, 3, map[string]interface{}{"state": "NY", "employees": "unknown"})
+	mustUpsert(t, s, 4, map[string]interface{}{"state": "CA"})
+
+	keys, err := indexer.IndexedKeys(ctx)
+	if err != nil {
+		t.Fatalf("IndexedKeys: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"employees"}) {
+		t.Errorf("IndexedKeys: got %v, want [employees]", keys)
+	}
+
+	check := func(name string) {
+		t.Helper()
+		for _, c := range []struct {
+			where string
+			asOf  time.Time
+			want  []int
+		}{
+			// "unknown" is not a number, so it compares as a string.
+			{"employees:gt:50", time.Time{}, []int{1, 2, 3}},
+			{"employees:gt:50", before, []int{1}},
+			{"employees:eq:9", time.Time{}, nil},
+			{"employees:eq:9", before, []int{2}},
+			{"employees:lte:90", time.Time{}, []int{2}},
+			{"employees:gte:a", time.Time{}, []int{3}},
+			{"employees:exists", time.Time{}, []int{1, 2, 3}},
+			{"employees:ne:90", time.Time{}, []int{1, 3, 4}},
+		} {
+			filter, err := service.ParseFilter(c.where)
+			if err != nil {
+				t.Fatalf("ParseFilter(%q): %v", c.where, err)
+			}
+			ids := listIDs(t, s, service.ListOptions{Filters: []service.Filter{filter}, AsOf: c.asOf})
+			if len(ids) == 0 {
+				ids = nil
+			}
+			if !reflect.DeepEqual(ids, c.want) {
+				t.Errorf("%s: %s as of %v: got ids %v, want %v", name, c.where, c.asOf, ids, c.want)
+			}
+		}
+	}
+
+	check("indexed")
+	if err := indexer.RebuildIndexes(ctx); err != nil {
+		t.Fatalf("RebuildIndexes: %v", err)
+	}
+	check("rebuilt")
+	if err := indexer.DropIndex(ctx, "employees"); err != nil {
+		t.Fatalf("DropIndex: %v", err)
+	}
+	check("dropped")
+}
+
+func testSearchRecords(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	mustUpsert(t, s, 1, map[string]interface{}{"name": "Acme Bakery", "address": "1 Old Road"})
+	mustUpsert(t, s, 1, map[string]interface{}{"address": "2 New Street"})
+	mustUpsert(t, s, 2, map[string]interface{}{"name": "Acme Plumbing, Ltd.", "address": "9 Old Road"})
+	mustUpsert(t, s, 3, map[string]interface{}{"name": "Zenith Café"})
+	if _, err := s.DeleteRecord(ctx, 3, service.WriteOptions{}); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+
+	type hit struct{ id, version int }
+	for _, c := range []struct {
+		opts service.SearchOptions
+		want []hit
+	}{
+		{service.SearchOptions{Query: "acme"}, []hit{{1, 2}, {2, 1}}},
+		{service.SearchOptions{Query: "ACME old"}, []hit{{2, 1}}},
+		{service.SearchOptions{Query: "old road", AllVersions: true}, []hit{{1, 1}, {2, 1}}},
+		{service.SearchOptions{Query: "plumb*"}, []hit{{2, 1}}},
+		{service.SearchOptions{Query: "plumb"}, nil},
+		{service.SearchOptions{Query: "ltd"}, []hit{{2, 1}}},
+		{service.SearchOptions{Query: "zenith", AllVersions: true}, []hit{{3, 1}}},
+		{service.SearchOptions{Query: "zenith"}, nil},
+		{service.SearchOptions{Query: "CAFÉ", AllVersions: true}, []hit{{3, 1}}},
+		{service.SearchOptions{Query: "cafe", AllVersions: true}, nil},
+		{service.SearchOptions{Query: "acme", AllVersions: true, Limit: 2}, []hit{{1, 1}, {1, 2}}},
+		{service.SearchOptions{Query: `"acme" OR NOT`}, nil},
+	} {
+		records, err := s.SearchRecords(ctx, c.opts)
+		if err != nil {
+			t.Fatalf("SearchRecords(%+v): %v", c.opts, err)
+		}
+		var got []hit
+		for _, record := range records {
+			got = append(got, hit{record.ID, record.Version})
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("SearchRecords(%+v): got %v, want %v", c.opts, got, c.want)
+		}
+	}
+
+	if _, err := s.SearchRecords(ctx, service.SearchOptions{Query: " ,. "}); !errors.Is(err, service.ErrEmptySearch) {
+		t.Errorf("SearchRecords with no words: got %v, want ErrEmptySearch", err)
+	}
+}
+
+// snapshot returns "collection/id@version" for each record of a snapshot.
+func snapshot(t *testing.T, s service.RecordService, at time.Time) []string {
+	t.Helper()
+	var got []string
+	err := s.Snapshot(context.Background(), at, func(record entity.Record) error {
+		got = append(got, fmt.Sprintf("%s/%d@%d", record.Collection, record.ID, record.Version))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Snapshot(%v): %v", at, err)
+	}
+	return got
+}
+
+func testSnapshot(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+
+	policies, err := s.Collection("policies")
+	if err != nil {
+		t.Fatalf("Collection: %v", err)
+	}
+
+	beforeCreate := time.Now()
+	mustUpsert(t, s, 2, map[string]interface{}{"name": "Acme"})
+	mustUpsert(t, s, 1, map[string]interface{}{"name": "Globex"})
+	quarterEnd := mustUpsert(t, policies, 1, map[string]interface{}{"policy": "GL-1"}).RecordedAt
+
+	mustUpsert(t, s, 1, map[string]interface{}{"name": "Globex Corp"})
+	if _, err := s.DeleteRecord(ctx, 2, service.WriteOptions{}); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+	mustUpsert(t, s, 3, map[string]interface{}{"name": "Initech"})
+
+	if got := snapshot(t, s, beforeCreate); len(got) != 0 {
+		t.Errorf("Snapshot before any record: got %v, want none", got)
+	}
+	if got, want := snapshot(t, s, quarterEnd), []string{"policies/1@1", "records/1@1", "records/2@1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Snapshot(quarter end): got %v, want %v", got, want)
+	}
+	if got, want := snapshot(t, s, time.Now()), []string{"policies/1@1", "records/1@2", "records/3@1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Snapshot(now): got %v, want %v", got, want)
+	}
+
+	// Writes made while a snapshot is read are not part of it, even though
+	// they happen before the snapshot's time.
+	var got []string
+	err = s.Snapshot(ctx, time.Now().Add(time.Hour), func(record entity.Record) error {
+		if len(got) == 0 {
+			mustUpsert(t, s, 1, map[string]interface{}{"name": "Globex Inc"})
+			mustUpsert(t, s, 4, map[string]interface{}{"name": "Hooli"})
+		}
+		got = append(got, fmt.Sprintf("%s/%d@%d", record.Collection, record.ID, record.Version))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if want := []string{"policies/1@1", "records/1@2", "records/3@1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Snapshot with concurrent writes: got %v, want %v", got, want)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = s.Snapshot(ctx, time.Now(), func(record entity.Record) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("Snapshot stopped by fn: got %v after %d calls, want stop after 1", err, calls)
+	}
+}
+
+func testConcurrentUpdates(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+	const writers = 20
+	mustUpsert(t, s, 1, map[string]interface{}{})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.UpdateRecordWithVersion(ctx, 1, map[string]interface{}{"a": "x"}, service.WriteOptions{})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent UpdateRecordWithVersion: %v", err)
+		}
+	}
+
+	versions, err := s.GetRecordVersions(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecordVersions: %v", err)
+	}
+	if len(versions) != writers+1 {
+		t.Fatalf("got %d versions, want %d", len(versions), writers+1)
+	}
+	for i, version := range versions {
+		if version.Version != i+1 {
+			t.Errorf("versions are not contiguous: %+v", versions)
+			break
+		}
+	}
+}
+
+func testConcurrentUpserts(t *testing.T, s service.RecordService) {
+	ctx := context.Background()
+	const writers = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.UpsertRecord(ctx, 1, map[string]interface{}{"a": "x"}, service.WriteOptions{})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent UpsertRecord: %v", err)
+		}
+	}
+
+	record, err := s.GetRecord(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetRecord: %v", err)
+	}
+	if record.Version != writers {
+		t.Errorf("got version %d, want %d", record.Version, writers)
+	}
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+func (s *SQLiteRecordService) Snapshot(ctx context.Context, t time.Time, fn func(entity.Record) error) error {
+	// SQLite reads the whole result of a statement from the snapshot of the
+	// database its read transaction started with, however long the rows take
+	// to stream. In WAL mode writers carry on meanwhile.
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT `+recordColumns+`
+        FROM records r
+        WHERE version = (
+            SELECT MAX(version) FROM records
+            WHERE collection = r.collection AND id = r.id AND recorded_at <= ?
+        )
+          AND deleted = 0
+        ORDER BY collection, id
+    `, t.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return fmt.Errorf("failed to read snapshot: %w", err)
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
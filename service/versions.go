@@ -0,0 +1,81 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rainbowmga/timetravel/entity"
+)
+
+// describeVersions builds the version descriptors of a record from its full
+// history, which must be ordered by version.
+func describeVersions(history []entity.Record) ([]entity.VersionInfo, error) {
+	infos := make([]entity.VersionInfo, 0, len(history))
+	previous := map[string]interface{}{}
+	// tombstone is the data deleted by the previous version, if it deleted
+	// the record.
+	var tombstone map[string]interface{}
+
+	for _, record := range history {
+		// A delete removes every key, and a restore adds them back.
+		data := record.VisibleData()
+		dataJSON, err := json.Marshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal record data: %w", err)
+		}
+
+		diff := entity.DiffData(previous, data)
+		added, changed, removed := diff.AddedKeys(), diff.ChangedKeys(), diff.RemovedKeys()
+		keys := append(append(append([]string{}, added...), changed...), removed...)
+
+		summary := summarizeChange(added, changed, removed)
+		switch {
+		case record.Deleted:
+			summary = "deleted"
+		case tombstone != nil && entity.DiffData(tombstone, data).Empty():
+			summary = "restored"
+		case record.Version == 1 || tombstone != nil:
+			summary = fmt.Sprintf("created with %d keys", len(data))
+		}
+
+		infos = append(infos, entity.VersionInfo{
+			Version:       record.Version,
+			CreatedAt:     record.CreatedAt,
+			RecordedAt:    record.RecordedAt,
+			EffectiveFrom: record.EffectiveFrom,
+			EffectiveTo:   record.EffectiveTo,
+			Deleted:       record.Deleted,
+			Author:        record.Author,
+			Reason:        record.Reason,
+			SchemaVersion: record.SchemaVersion,
+			Summary:       summary,
+			Size:          len(dataJSON),
+			KeysTouched:   keys,
+		})
+		previous = data
+		tombstone = nil
+		if record.Deleted {
+			tombstone = record.Data
+		}
+	}
+
+	return infos, nil
+}
+
+func summarizeChange(added, changed, removed []string) string {
+	var parts []string
+	if len(added) > 0 {
+		parts = append(parts, "added "+strings.Join(added, ", "))
+	}
+	if len(changed) > 0 {
+		parts = append(parts, "changed "+strings.Join(changed, ", "))
+	}
+	if len(removed) > 0 {
+		parts = append(parts, "removed "+strings.Join(removed, ", "))
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, "; ")
+}